@@ -37,6 +37,7 @@ import (
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/solnx/mistral/internal/mistral"
 )
 
 // BasicAuth performs HTTP Basic authentication uses credentials stored
@@ -57,7 +58,7 @@ func BasicAuth(h httprouter.Handle) httprouter.Handle {
 					subtle.ConstantTimeCompare(pair[1], []byte(basicAuthPassword)) == 1 {
 
 					// Delegate request to the given handle
-					h(w, r, ps)
+					h(w, mistral.SetPrincipal(r, `user:`+string(pair[0])), ps)
 					return
 				}
 			}
@@ -0,0 +1,191 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/mistral/cmd/mistral"
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	"github.com/solnx/mistral/internal/mistral"
+)
+
+var clientCertBinding, clientCertPrefix string
+
+// ClientCertAuth checks that the request was made with a verified
+// TLS client certificate. If a HostID binding is configured, the
+// request is restricted to the HostIDs named in the certificate's
+// CN or SANs.
+func ClientCertAuth(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 ||
+			len(r.TLS.VerifiedChains[0]) == 0 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		leaf := r.TLS.VerifiedChains[0][0]
+		r = mistral.SetPrincipal(r, `subject:`+leaf.Subject.String())
+
+		var names []string
+		switch clientCertBinding {
+		case `cn`:
+			names = []string{leaf.Subject.CommonName}
+		case `san`:
+			names = append(names, leaf.DNSNames...)
+			names = append(names, leaf.EmailAddresses...)
+			for _, uri := range leaf.URIs {
+				names = append(names, uri.String())
+			}
+		case ``:
+			// no HostID binding
+			h(w, r, ps)
+			return
+		}
+
+		ids := []int{}
+		for _, name := range names {
+			if !strings.HasPrefix(name, clientCertPrefix) {
+				continue
+			}
+			id, err := strconv.Atoi(strings.TrimPrefix(name, clientCertPrefix))
+			if err != nil || id <= 0 {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			logrus.Warningf("Rejected client certificate %s from %s: no HostID",
+				leaf.Subject.String(), r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		// Delegate request to the given handle
+		h(w, mistral.BindHostIDs(r, ids), ps)
+	}
+}
+
+// validClientCertBinding returns an error if binding is not a known
+// tls.client.hostid.binding
+func validClientCertBinding(binding string) error {
+	switch binding {
+	case ``, `cn`, `san`:
+		return nil
+	default:
+		return fmt.Errorf("Unknown client certificate HostID binding: %s",
+			binding)
+	}
+}
+
+// loadClientCAs reads the client CA certificates in PEM format from
+// files
+func loadClientCAs(files []string) ([]*x509.Certificate, error) {
+	cas := []*x509.Certificate{}
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != `CERTIFICATE` {
+				continue
+			}
+			ca, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err)
+			}
+			cas = append(cas, ca)
+		}
+		if len(cas) == 0 {
+			return nil, fmt.Errorf("%s: no certificates found", file)
+		}
+	}
+	return cas, nil
+}
+
+// loadCRLs reads the certificate revocation lists in PEM or DER
+// format from files. Every list must be signed by one of the client
+// CAs in cas.
+func loadCRLs(files []string, cas []*x509.Certificate) ([]*x509.RevocationList, error) {
+	crls := []*x509.RevocationList{}
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// PEM files may contain multiple lists
+		ders := [][]byte{}
+		for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == `X509 CRL` {
+				ders = append(ders, block.Bytes)
+			}
+		}
+		if len(ders) == 0 {
+			ders = append(ders, raw)
+		}
+
+		for _, der := range ders {
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err)
+			}
+			if !signedByCA(crl, cas) {
+				return nil, fmt.Errorf("%s: not signed by a client CA", file)
+			}
+			crls = append(crls, crl)
+		}
+	}
+	return crls, nil
+}
+
+// signedByCA returns true if crl carries a valid signature of one of
+// the certificates in cas
+func signedByCA(crl *x509.RevocationList, cas []*x509.Certificate) bool {
+	for _, ca := range cas {
+		if string(ca.RawSubject) != string(crl.RawIssuer) {
+			continue
+		}
+		if crl.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCRLs returns a tls.Config.VerifyPeerCertificate function that
+// rejects client certificate chains containing a revoked certificate
+func checkCRLs(crls []*x509.RevocationList) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				for _, crl := range crls {
+					if string(crl.RawIssuer) != string(cert.RawIssuer) {
+						continue
+					}
+					for _, entry := range crl.RevokedCertificateEntries {
+						if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+							return fmt.Errorf("Certificate %s is revoked",
+								cert.Subject.String())
+						}
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,290 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/mistral/cmd/mistral"
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/solnx/mistral/internal/mistral"
+)
+
+// testCA is a certificate authority for client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA returns a self-signed CA with the common name cn
+func newTestCA(t *testing.T, cn string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a client certificate for tmpl signed by ca
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// crlFile writes a PEM encoded CRL signed by ca that revokes serials
+// and returns its filename
+func (ca *testCA) crlFile(t *testing.T, dir string, serials ...int64) string {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{
+				SerialNumber:   big.NewInt(serial),
+				RevocationTime: time.Now(),
+			})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err := ioutil.TempFile(dir, `crl`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if err := pem.Encode(fh, &pem.Block{Type: `X509 CRL`, Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	return fh.Name()
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca := newTestCA(t, `client ca`)
+	uri, _ := url.Parse(`spiffe://hostid-7`)
+
+	tests := []struct {
+		name    string
+		binding string
+		cert    *x509.Certificate
+		status  int
+		ids     []int
+	}{
+		{
+			name:    `no client certificate`,
+			binding: `cn`,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    `no binding`,
+			binding: ``,
+			cert: &x509.Certificate{
+				SerialNumber: big.NewInt(2),
+				Subject:      pkix.Name{CommonName: `agent`},
+			},
+			status: http.StatusOK,
+		},
+		{
+			name:    `cn binding`,
+			binding: `cn`,
+			cert: &x509.Certificate{
+				SerialNumber: big.NewInt(3),
+				Subject:      pkix.Name{CommonName: `hostid-42`},
+			},
+			status: http.StatusOK,
+			ids:    []int{42},
+		},
+		{
+			name:    `cn binding without HostID`,
+			binding: `cn`,
+			cert: &x509.Certificate{
+				SerialNumber: big.NewInt(4),
+				Subject:      pkix.Name{CommonName: `agent`},
+				DNSNames:     []string{`hostid-42`},
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name:    `san binding`,
+			binding: `san`,
+			cert: &x509.Certificate{
+				SerialNumber:   big.NewInt(5),
+				Subject:        pkix.Name{CommonName: `hostid-1`},
+				DNSNames:       []string{`hostid-5`, `agent.example.com`},
+				EmailAddresses: []string{`hostid-6`},
+				URIs:           []*url.URL{uri},
+			},
+			status: http.StatusOK,
+			ids:    []int{5, 6},
+		},
+		{
+			name:    `san binding skips invalid HostIDs`,
+			binding: `san`,
+			cert: &x509.Certificate{
+				SerialNumber: big.NewInt(6),
+				DNSNames:     []string{`hostid-0`, `hostid-x`, `hostid-9`},
+			},
+			status: http.StatusOK,
+			ids:    []int{9},
+		},
+	}
+
+	clientCertPrefix = `hostid-`
+	for _, tt := range tests {
+		clientCertBinding = tt.binding
+
+		var ids []int
+		var bound bool
+		var principal string
+		h := ClientCertAuth(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			ids, bound = mistral.BoundHostIDs(r)
+			principal = mistral.Principal(r)
+		})
+
+		r := httptest.NewRequest(`POST`, `/api/metrics`, nil)
+		if tt.cert != nil {
+			r.TLS = &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{
+					{ca.issue(t, tt.cert), ca.cert},
+				},
+			}
+		}
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.name, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if principal == `` {
+			t.Errorf("%s: no principal set", tt.name)
+		}
+		if bound != (tt.ids != nil) || !reflect.DeepEqual(ids, tt.ids) {
+			t.Errorf("%s: bound HostIDs %v (%t), expected %v", tt.name,
+				ids, bound, tt.ids)
+		}
+	}
+}
+
+func TestValidClientCertBinding(t *testing.T) {
+	tests := map[string]bool{
+		``:     true,
+		`cn`:   true,
+		`san`:  true,
+		`CN`:   false,
+		`sans`: false,
+	}
+	for binding, valid := range tests {
+		if err := validClientCertBinding(binding); (err == nil) != valid {
+			t.Errorf("binding %q: %v, expected valid %t", binding, err, valid)
+		}
+	}
+}
+
+func TestClientCertCRLs(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `mistral-crl`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, `client ca`)
+	revoked := ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(10),
+		Subject:      pkix.Name{CommonName: `hostid-10`},
+	})
+	valid := ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(11),
+		Subject:      pkix.Name{CommonName: `hostid-11`},
+	})
+
+	crls, err := loadCRLs([]string{ca.crlFile(t, dir, 10)}, []*x509.Certificate{ca.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := checkCRLs(crls)
+	if err := verify(nil, [][]*x509.Certificate{{revoked, ca.cert}}); err == nil {
+		t.Error(`revoked certificate was accepted`)
+	}
+	if err := verify(nil, [][]*x509.Certificate{{valid, ca.cert}}); err != nil {
+		t.Errorf("valid certificate was rejected: %s", err)
+	}
+	// requests without a client certificate are left to ClientCertAuth
+	if err := verify(nil, nil); err != nil {
+		t.Errorf("missing certificate was rejected: %s", err)
+	}
+
+	// a CRL with the issuer name of the CA, but signed by another key,
+	// is not trusted
+	forger := newTestCA(t, `client ca`)
+	if _, err := loadCRLs([]string{forger.crlFile(t, dir, 11)},
+		[]*x509.Certificate{ca.cert}); err == nil {
+		t.Error(`forged CRL was loaded`)
+	}
+	if _, err := loadCRLs([]string{filepath.Join(dir, `missing`)},
+		[]*x509.Certificate{ca.cert}); err == nil {
+		t.Error(`missing CRL file was loaded`)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,56 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/mistral/cmd/mistral"
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	"github.com/solnx/mistral/internal/mistral"
+)
+
+// HMACAuth checks that the request carries a signature and a recent
+// timestamp. The signature itself is verified with the secret of the
+// submitted HostID once the request body has been parsed.
+func HMACAuth(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		timestamp := r.Header.Get(`X-Mistral-Timestamp`)
+		signature, err := hex.DecodeString(r.Header.Get(`X-Mistral-Signature`))
+		if err != nil || len(signature) == 0 {
+			logrus.Warningf("Rejected request without signature from %s",
+				r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		// reject requests signed outside the replay window
+		sec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			logrus.Warningf("Rejected invalid timestamp from %s", r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		skew := time.Since(time.Unix(sec, 0))
+		if skew > mistral.SignatureWindow || -skew > mistral.SignatureWindow {
+			logrus.Warningf("Rejected expired signature from %s: timestamp %s",
+				r.RemoteAddr, timestamp)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		// Delegate request to the given handle
+		h(w, mistral.RequireSignature(r, timestamp, signature), ps)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,68 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/mistral/cmd/mistral"
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/solnx/mistral/internal/mistral"
+)
+
+func TestHMACAuthTimestampWindow(t *testing.T) {
+	now := time.Now()
+	window := mistral.SignatureWindow
+	unix := func(ts time.Time) string {
+		return strconv.FormatInt(ts.Unix(), 10)
+	}
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		status    int
+	}{
+		{`current timestamp`, unix(now), `00ff`, http.StatusOK},
+		{`timestamp within the window`, unix(now.Add(-window + time.Minute)), `00ff`, http.StatusOK},
+		{`timestamp ahead within the window`, unix(now.Add(window - time.Minute)), `00ff`, http.StatusOK},
+		{`expired timestamp`, unix(now.Add(-window - time.Minute)), `00ff`, http.StatusUnauthorized},
+		{`timestamp too far ahead`, unix(now.Add(window + time.Minute)), `00ff`, http.StatusUnauthorized},
+		{`invalid timestamp`, `yesterday`, `00ff`, http.StatusUnauthorized},
+		{`missing timestamp`, ``, `00ff`, http.StatusUnauthorized},
+		{`missing signature`, unix(now), ``, http.StatusUnauthorized},
+		{`invalid signature encoding`, unix(now), `xyz`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		called := false
+		h := HMACAuth(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			called = true
+		})
+
+		r := httptest.NewRequest(`POST`, `/api/metrics`, nil)
+		if tt.timestamp != `` {
+			r.Header.Set(`X-Mistral-Timestamp`, tt.timestamp)
+		}
+		if tt.signature != `` {
+			r.Header.Set(`X-Mistral-Signature`, tt.signature)
+		}
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+
+		if w.Code != tt.status || called != (tt.status == http.StatusOK) {
+			t.Errorf("%s: status %d, handler called %t, expected %d",
+				tt.name, w.Code, called, tt.status)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
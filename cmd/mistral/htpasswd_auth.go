@@ -0,0 +1,138 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/mistral/cmd/mistral"
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	"github.com/solnx/mistral/internal/mistral"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var htpasswd *htpasswdFile
+
+// htpasswdFile holds the users of an htpasswd file
+type htpasswdFile struct {
+	path  string
+	mux   sync.RWMutex
+	users map[string]string
+	// dummy is compared against for unknown users, so that they
+	// take as long to reject as wrong passwords
+	dummy []byte
+}
+
+// newHtpasswdFile reads the htpasswd file at path
+func newHtpasswdFile(path string) (*htpasswdFile, error) {
+	dummy, err := bcrypt.GenerateFromPassword([]byte(`dummy`),
+		bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	h := &htpasswdFile{
+		path:  path,
+		users: make(map[string]string),
+		dummy: dummy,
+	}
+	return h, h.load()
+}
+
+// load reads the htpasswd file and replaces the known users. Only
+// bcrypt and {SHA} hashes are supported.
+func (h *htpasswdFile) load() error {
+	fh, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == `` || strings.HasPrefix(text, `#`) {
+			continue
+		}
+		pair := strings.SplitN(text, `:`, 2)
+		if len(pair) != 2 || pair[0] == `` {
+			return fmt.Errorf("%s:%d: invalid entry", h.path, line)
+		}
+		switch {
+		case strings.HasPrefix(pair[1], `$2a$`),
+			strings.HasPrefix(pair[1], `$2b$`),
+			strings.HasPrefix(pair[1], `$2y$`),
+			strings.HasPrefix(pair[1], `{SHA}`):
+		default:
+			logrus.Warnf("%s:%d: unsupported hash for user %s, skipped",
+				h.path, line, pair[0])
+			continue
+		}
+		users[pair[0]] = pair[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mux.Lock()
+	h.users = users
+	h.mux.Unlock()
+	logrus.Infof("Loaded %d users from %s", len(users), h.path)
+	return nil
+}
+
+// verify checks the password for user
+func (h *htpasswdFile) verify(user, password string) bool {
+	h.mux.RLock()
+	hash, ok := h.users[user]
+	h.mux.RUnlock()
+
+	switch {
+	case !ok:
+		bcrypt.CompareHashAndPassword(h.dummy, []byte(password))
+		return false
+	case strings.HasPrefix(hash, `{SHA}`):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare(
+			[]byte(strings.TrimPrefix(hash, `{SHA}`)),
+			[]byte(base64.StdEncoding.EncodeToString(sum[:])),
+		) == 1
+	default:
+		return bcrypt.CompareHashAndPassword(
+			[]byte(hash), []byte(password)) == nil
+	}
+}
+
+// HtpasswdAuth performs HTTP Basic authentication against the users
+// of the configured htpasswd file
+func HtpasswdAuth(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if user, password, ok := r.BasicAuth(); ok &&
+			htpasswd.verify(user, password) {
+
+			// Delegate request to the given handle
+			h(w, mistral.SetPrincipal(r, `user:`+user), ps)
+			return
+		}
+
+		// Request Basic Authentication otherwise
+		w.Header().Set(`WWW-Authenticate`, `Basic realm=Restricted`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,171 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/mistral/cmd/mistral"
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/solnx/mistral/internal/mistral"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd writes the htpasswd file at path with the given lines
+func writeHtpasswd(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	content := ``
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testHtpasswd returns an htpasswd file with a bcrypt user alice, a
+// {SHA} user bob and an unsupported MD5 user carol
+func testHtpasswd(t *testing.T) *htpasswdFile {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `mistral-htpasswd`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(`wonderland`), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte(`builder`))
+	path := filepath.Join(dir, `htpasswd`)
+	writeHtpasswd(t, path,
+		`# users`,
+		``,
+		`alice:`+string(hash),
+		`bob:{SHA}`+base64.StdEncoding.EncodeToString(sum[:]),
+		`carol:$apr1$salt$hash`,
+	)
+
+	h, err := newHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHtpasswdVerify(t *testing.T) {
+	h := testHtpasswd(t)
+
+	tests := []struct {
+		user     string
+		password string
+		valid    bool
+	}{
+		{`alice`, `wonderland`, true},
+		{`alice`, `builder`, false},
+		{`alice`, ``, false},
+		{`bob`, `builder`, true},
+		{`bob`, `wonderland`, false},
+		{`carol`, `hash`, false},
+		{`dave`, `wonderland`, false},
+		{``, ``, false},
+	}
+	for _, tt := range tests {
+		if got := h.verify(tt.user, tt.password); got != tt.valid {
+			t.Errorf("user %q with password %q: %t, expected %t",
+				tt.user, tt.password, got, tt.valid)
+		}
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	h := testHtpasswd(t)
+
+	sum := sha1.Sum([]byte(`secret`))
+	writeHtpasswd(t, h.path,
+		`dave:{SHA}`+base64.StdEncoding.EncodeToString(sum[:]),
+	)
+	if err := h.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !h.verify(`dave`, `secret`) {
+		t.Error(`added user dave was rejected after the reload`)
+	}
+	if h.verify(`alice`, `wonderland`) {
+		t.Error(`removed user alice was accepted after the reload`)
+	}
+
+	// an invalid file keeps the loaded users
+	writeHtpasswd(t, h.path, `invalid`)
+	if err := h.load(); err == nil {
+		t.Error(`invalid htpasswd file was loaded`)
+	}
+	if !h.verify(`dave`, `secret`) {
+		t.Error(`user dave was rejected after a failed reload`)
+	}
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	htpasswd = testHtpasswd(t)
+	defer func() { htpasswd = nil }()
+
+	var principal string
+	h := HtpasswdAuth(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		principal = mistral.Principal(r)
+	})
+
+	tests := []struct {
+		user     string
+		password string
+		status   int
+	}{
+		{`alice`, `wonderland`, http.StatusOK},
+		{`alice`, `builder`, http.StatusUnauthorized},
+		{`dave`, `wonderland`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		principal = ``
+		r := httptest.NewRequest(`POST`, `/api/metrics`, nil)
+		r.SetBasicAuth(tt.user, tt.password)
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+
+		if w.Code != tt.status {
+			t.Errorf("user %q: status %d, expected %d", tt.user, w.Code, tt.status)
+			continue
+		}
+		switch tt.status {
+		case http.StatusOK:
+			if principal != `user:`+tt.user {
+				t.Errorf("user %q: principal %q", tt.user, principal)
+			}
+		default:
+			if w.Header().Get(`WWW-Authenticate`) == `` {
+				t.Errorf("user %q: no WWW-Authenticate header", tt.user)
+			}
+		}
+	}
+
+	// requests without credentials are challenged as well
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(`POST`, `/api/metrics`, nil), nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("no credentials: status %d, expected %d", w.Code,
+			http.StatusUnauthorized)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,206 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/mistral/cmd/mistral"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/solnx/mistral/internal/mistral"
+)
+
+var jwks *jwksFile
+
+var jwtIssuer, jwtAudience, jwtHostIDClaim string
+
+// jwtAlgorithms are the accepted token signature algorithms
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256,
+	jose.ES256,
+	jose.EdDSA,
+}
+
+// jwksFile holds the keys of a JSON Web Key Set file
+type jwksFile struct {
+	path string
+	mux  sync.RWMutex
+	keys jose.JSONWebKeySet
+}
+
+// newJWKSFile reads the key set file at path
+func newJWKSFile(path string) (*jwksFile, error) {
+	k := &jwksFile{
+		path: path,
+	}
+	return k, k.load()
+}
+
+// load reads the key set file and replaces the known keys
+func (k *jwksFile) load() error {
+	raw, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+
+	keys := jose.JSONWebKeySet{}
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return fmt.Errorf("%s: %s", k.path, err)
+	}
+	if len(keys.Keys) == 0 {
+		return fmt.Errorf("%s: no keys", k.path)
+	}
+	for _, key := range keys.Keys {
+		if !key.IsPublic() {
+			return fmt.Errorf("%s: key %s is not a public key",
+				k.path, key.KeyID)
+		}
+	}
+
+	k.mux.Lock()
+	k.keys = keys
+	k.mux.Unlock()
+	logrus.Infof("Loaded %d keys from %s", len(keys.Keys), k.path)
+	return nil
+}
+
+// lookup returns the keys that may have signed a token with the key
+// ID kid. Tokens without key ID are checked against all keys.
+func (k *jwksFile) lookup(kid string) []jose.JSONWebKey {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	if kid == `` {
+		return k.keys.Keys
+	}
+	return k.keys.Key(kid)
+}
+
+// verify checks the signature and claims of token. It returns the
+// token subject and the HostIDs of the configured scope claim.
+func (k *jwksFile) verify(token string) (string, []int, error) {
+	tok, err := jwt.ParseSigned(token, jwtAlgorithms)
+	if err != nil {
+		return ``, nil, err
+	}
+
+	claims := jwt.Claims{}
+	custom := map[string]interface{}{}
+	verified := false
+	for _, key := range k.lookup(tok.Headers[0].KeyID) {
+		if err = tok.Claims(key.Key, &claims, &custom); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return ``, nil, fmt.Errorf("invalid signature")
+	}
+
+	if claims.Expiry == nil {
+		return ``, nil, fmt.Errorf("missing exp claim")
+	}
+	expected := jwt.Expected{
+		Issuer:      jwtIssuer,
+		AnyAudience: jwt.Audience{jwtAudience},
+		Time:        time.Now(),
+	}
+	if err = claims.Validate(expected); err != nil {
+		return ``, nil, err
+	}
+
+	if jwtHostIDClaim == `` {
+		return claims.Subject, nil, nil
+	}
+	ids, err := parseHostIDClaim(custom[jwtHostIDClaim])
+	if err != nil {
+		return ``, nil, fmt.Errorf("claim %s: %s", jwtHostIDClaim, err)
+	}
+	return claims.Subject, ids, nil
+}
+
+// parseHostIDClaim parses a HostID scope claim that holds a single
+// HostID or a list of HostIDs, as numbers or strings
+func parseHostIDClaim(claim interface{}) ([]int, error) {
+	values, ok := claim.([]interface{})
+	if !ok {
+		values = []interface{}{claim}
+	}
+
+	ids := []int{}
+	for _, value := range values {
+		var id int
+		switch v := value.(type) {
+		case float64:
+			id = int(v)
+			if float64(id) != v {
+				return nil, fmt.Errorf("invalid HostID %v", v)
+			}
+		case string:
+			var err error
+			if id, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid HostID %s", v)
+			}
+		case nil:
+			return nil, fmt.Errorf("missing")
+		default:
+			return nil, fmt.Errorf("invalid HostID %v", v)
+		}
+		if id <= 0 {
+			return nil, fmt.Errorf("invalid HostID %d", id)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no HostID")
+	}
+	return ids, nil
+}
+
+// JWTAuth performs bearer token authentication with JSON Web Tokens
+// signed by a key of the configured key set. If a HostID claim is
+// configured, the request is restricted to the HostIDs it names.
+func JWTAuth(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		const prefix = `Bearer `
+		auth := r.Header.Get(`Authorization`)
+		if len(auth) > len(prefix) &&
+			strings.EqualFold(auth[:len(prefix)], prefix) {
+
+			subject, ids, err := jwks.verify(
+				strings.TrimSpace(auth[len(prefix):]))
+			if err == nil {
+				r = mistral.SetPrincipal(r, `token:`+subject)
+				if ids != nil {
+					r = mistral.BindHostIDs(r, ids)
+				}
+
+				// Delegate request to the given handle
+				h(w, r, ps)
+				return
+			}
+			logrus.Warningf("Rejected bearer token from %s: %s",
+				r.RemoteAddr, err)
+		}
+
+		// Request Bearer Authentication otherwise
+		w.Header().Set(`WWW-Authenticate`, `Bearer realm=Restricted`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,312 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/mistral/cmd/mistral"
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/solnx/mistral/internal/mistral"
+)
+
+// testJWKS returns a key set file with the public key of an ES256
+// signing key with the key ID k1, and the signing key
+func testJWKS(t *testing.T) (*jwksFile, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{
+			Key:       &key.PublicKey,
+			KeyID:     `k1`,
+			Algorithm: string(jose.ES256),
+			Use:       `sig`,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir(``, `mistral-jwks`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, `jwks.json`)
+	if err := ioutil.WriteFile(path, raw, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := newJWKSFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, key
+}
+
+// signToken returns the token with claims and custom, signed by key
+// using alg and the key ID kid
+func signToken(t *testing.T, alg jose.SignatureAlgorithm, key interface{},
+	kid string, claims jwt.Claims, custom map[string]interface{}) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: key, KeyID: kid},
+	}, (&jose.SignerOptions{}).WithType(`JWT`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Claims(custom).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// setJWTSettings sets the JWT settings for the duration of a test
+func setJWTSettings(t *testing.T, issuer, audience, claim string) {
+	jwtIssuer, jwtAudience, jwtHostIDClaim = issuer, audience, claim
+	t.Cleanup(func() {
+		jwtIssuer, jwtAudience, jwtHostIDClaim = ``, ``, ``
+	})
+}
+
+func TestJWKSVerify(t *testing.T) {
+	k, key := testJWKS(t)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setJWTSettings(t, `https://auth.example.com`, `mistral`, `host_ids`)
+
+	now := time.Now()
+	valid := jwt.Claims{
+		Subject:  `agent01`,
+		Issuer:   `https://auth.example.com`,
+		Audience: jwt.Audience{`mistral`},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+		IssuedAt: jwt.NewNumericDate(now),
+	}
+	with := func(change func(*jwt.Claims)) jwt.Claims {
+		c := valid
+		change(&c)
+		return c
+	}
+	hosts := map[string]interface{}{`host_ids`: []int{1, 2}}
+
+	tests := []struct {
+		name   string
+		token  string
+		ids    []int
+		errMsg string
+	}{
+		{
+			name:  `valid token`,
+			token: signToken(t, jose.ES256, key, `k1`, valid, hosts),
+			ids:   []int{1, 2},
+		},
+		{
+			name:  `token without key ID`,
+			token: signToken(t, jose.ES256, key, ``, valid, hosts),
+			ids:   []int{1, 2},
+		},
+		{
+			name: `one of several audiences`,
+			token: signToken(t, jose.ES256, key, `k1`, with(func(c *jwt.Claims) {
+				c.Audience = jwt.Audience{`other`, `mistral`}
+			}), hosts),
+			ids: []int{1, 2},
+		},
+		{
+			name:   `unknown signing key`,
+			token:  signToken(t, jose.ES256, other, `k1`, valid, hosts),
+			errMsg: `invalid signature`,
+		},
+		{
+			name:   `unaccepted algorithm`,
+			token:  signToken(t, jose.HS256, []byte(`0123456789abcdef0123456789abcdef`), `k1`, valid, hosts),
+			errMsg: `unexpected signature algorithm`,
+		},
+		{
+			name: `missing exp`,
+			token: signToken(t, jose.ES256, key, `k1`, with(func(c *jwt.Claims) {
+				c.Expiry = nil
+			}), hosts),
+			errMsg: `missing exp claim`,
+		},
+		{
+			name: `expired`,
+			token: signToken(t, jose.ES256, key, `k1`, with(func(c *jwt.Claims) {
+				c.Expiry = jwt.NewNumericDate(now.Add(-time.Hour))
+			}), hosts),
+			errMsg: `expired`,
+		},
+		{
+			name: `wrong issuer`,
+			token: signToken(t, jose.ES256, key, `k1`, with(func(c *jwt.Claims) {
+				c.Issuer = `https://other.example.com`
+			}), hosts),
+			errMsg: `issuer`,
+		},
+		{
+			name: `wrong audience`,
+			token: signToken(t, jose.ES256, key, `k1`, with(func(c *jwt.Claims) {
+				c.Audience = jwt.Audience{`other`}
+			}), hosts),
+			errMsg: `audience`,
+		},
+		{
+			name:   `missing HostID claim`,
+			token:  signToken(t, jose.ES256, key, `k1`, valid, nil),
+			errMsg: `claim host_ids: missing`,
+		},
+		{
+			name:   `malformed token`,
+			token:  `not.a.token`,
+			errMsg: `illegal base64`,
+		},
+	}
+	for _, tt := range tests {
+		subject, ids, err := k.verify(tt.token)
+		if tt.errMsg != `` {
+			if err == nil {
+				t.Errorf("%s: expected error %q", tt.name, tt.errMsg)
+			} else if !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("%s: error %q, expected %q", tt.name, err, tt.errMsg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if subject != `agent01` || !reflect.DeepEqual(ids, tt.ids) {
+			t.Errorf("%s: subject %q with HostIDs %v, expected agent01 with %v",
+				tt.name, subject, ids, tt.ids)
+		}
+	}
+}
+
+func TestParseHostIDClaim(t *testing.T) {
+	tests := []struct {
+		claim interface{}
+		ids   []int
+	}{
+		{float64(42), []int{42}},
+		{`42`, []int{42}},
+		{[]interface{}{float64(1), `2`}, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		ids, err := parseHostIDClaim(tt.claim)
+		if err != nil || !reflect.DeepEqual(ids, tt.ids) {
+			t.Errorf("claim %#v: %v, %v, expected %v", tt.claim, ids, err, tt.ids)
+		}
+	}
+}
+
+func TestParseHostIDClaimMalformed(t *testing.T) {
+	tests := []struct {
+		claim interface{}
+		err   string
+	}{
+		{nil, `missing`},
+		{float64(1.5), `invalid HostID 1.5`},
+		{`x`, `invalid HostID x`},
+		{float64(0), `invalid HostID 0`},
+		{`-1`, `invalid HostID -1`},
+		{true, `invalid HostID true`},
+		{[]interface{}{}, `no HostID`},
+		{[]interface{}{float64(1), nil}, `missing`},
+	}
+	for _, tt := range tests {
+		_, err := parseHostIDClaim(tt.claim)
+		if err == nil {
+			t.Errorf("claim %#v: expected error %q", tt.claim, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("claim %#v: error %q, expected %q", tt.claim, err, tt.err)
+		}
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	var key *ecdsa.PrivateKey
+	jwks, key = testJWKS(t)
+	defer func() { jwks = nil }()
+	setJWTSettings(t, `https://auth.example.com`, `mistral`, `host_ids`)
+
+	var principal string
+	var ids []int
+	h := JWTAuth(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		principal = mistral.Principal(r)
+		ids, _ = mistral.BoundHostIDs(r)
+	})
+
+	token := signToken(t, jose.ES256, key, `k1`, jwt.Claims{
+		Subject:  `agent01`,
+		Issuer:   `https://auth.example.com`,
+		Audience: jwt.Audience{`mistral`},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}, map[string]interface{}{`host_ids`: `7`})
+
+	tests := []struct {
+		header string
+		status int
+	}{
+		{`Bearer ` + token, http.StatusOK},
+		{`bearer ` + token, http.StatusOK},
+		{`Bearer ` + token + `x`, http.StatusUnauthorized},
+		{`Basic ` + token, http.StatusUnauthorized},
+		{``, http.StatusUnauthorized},
+	}
+	for i, tt := range tests {
+		principal, ids = ``, nil
+		r := httptest.NewRequest(`POST`, `/api/metrics`, nil)
+		if tt.header != `` {
+			r.Header.Set(`Authorization`, tt.header)
+		}
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+
+		if w.Code != tt.status {
+			t.Errorf("request %d: status %d, expected %d", i, w.Code, tt.status)
+			continue
+		}
+		switch tt.status {
+		case http.StatusOK:
+			if principal != `token:agent01` || !reflect.DeepEqual(ids, []int{7}) {
+				t.Errorf("request %d: principal %q with HostIDs %v", i,
+					principal, ids)
+			}
+		default:
+			if w.Header().Get(`WWW-Authenticate`) == `` {
+				t.Errorf("request %d: no WWW-Authenticate header", i)
+			}
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -24,6 +24,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/Sirupsen/logrus"
 	"github.com/client9/reopen"
 	"github.com/julienschmidt/httprouter"
@@ -68,7 +69,7 @@ func main() {
 	}
 
 	// read runtime configuration
-	conf := erebos.Config{}
+	conf := mistral.Config{}
 	if err := conf.FromFile(cliConfPath); err != nil {
 		logrus.Fatalf("Could not open configuration: %s", err)
 	}
@@ -88,7 +89,29 @@ func main() {
 	if conf.Log.Rotate {
 		sigChanLogRotate := make(chan os.Signal, 1)
 		signal.Notify(sigChanLogRotate, syscall.SIGUSR2)
-		go erebos.Logrotate(sigChanLogRotate, conf)
+		go erebos.Logrotate(sigChanLogRotate, conf.Config)
+	}
+
+	// setup optional access log, reopened on USR2 as well
+	if conf.Mistral.AccessLogFile != `` {
+		afh, err := reopen.NewFileWriter(
+			filepath.Join(conf.Log.Path, conf.Mistral.AccessLogFile),
+		)
+		if err != nil {
+			logrus.Fatalf("Unable to open access log: %s", err)
+		}
+		mistral.AccessLog = afh
+		if conf.Log.Rotate {
+			sigChanAccessLog := make(chan os.Signal, 1)
+			signal.Notify(sigChanAccessLog, syscall.SIGUSR2)
+			go func() {
+				for range sigChanAccessLog {
+					if err := afh.Reopen(); err != nil {
+						logrus.Errorf("Failed to reopen access log: %s", err)
+					}
+				}
+			}()
+		}
 	}
 
 	// setup signal receiver for graceful shutdown
@@ -115,7 +138,7 @@ func main() {
 	metrics.NewRegisteredMeter(`/messages`, pfxRegistry)
 	mistral.MtrReg = &pfxRegistry
 
-	ms := legacy.NewMetricSocket(&conf, &pfxRegistry, handlerDeath,
+	ms := legacy.NewMetricSocket(&conf.Config, &pfxRegistry, handlerDeath,
 		mistral.FormatMetrics)
 	ms.SetDebugFormatter(mistral.DebugFormatMetrics)
 	if conf.Misc.ProduceMetrics {
@@ -127,8 +150,30 @@ func main() {
 		}()
 	}
 
+	// fail before any handler starts if the producer settings are
+	// invalid
+	if _, err := mistral.ProducerConfig(&conf); err != nil {
+		logrus.Fatalf("Invalid Kafka producer configuration: %s", err)
+	}
+
 	// start application handlers
-	for i := 0; i < runtime.NumCPU(); i++ {
+	var handlerCount int
+	switch conf.Mistral.HandlerCount {
+	case 0:
+		handlerCount = runtime.NumCPU()
+	default:
+		handlerCount = conf.Mistral.HandlerCount
+	}
+	if err := mistral.SetSharding(conf.Mistral.HandlerSharding); err != nil {
+		logrus.Fatalln(err)
+	}
+	// requests wait this long for room in a full handler queue
+	if conf.Mistral.EnqueueTimeout > 0 {
+		mistral.EnqueueTimeout = time.Duration(
+			conf.Mistral.EnqueueTimeout,
+		) * time.Millisecond
+	}
+	for i := 0; i < handlerCount; i++ {
 		h := mistral.Mistral{
 			Num: i,
 			Input: make(chan *erebos.Transport,
@@ -147,6 +192,79 @@ func main() {
 		logrus.Infof("Launched Mistral handler #%d", i)
 	}
 
+	// setup optional disk spool for batches that can not be produced
+	replayDone := make(chan struct{})
+	if conf.Mistral.SpoolPath != `` {
+		var segSize, maxSize int64
+		switch conf.Mistral.SpoolSegmentSize {
+		case 0:
+			segSize = 64 * 1024 * 1024
+		default:
+			segSize = conf.Mistral.SpoolSegmentSize * 1024 * 1024
+		}
+		maxSize = conf.Mistral.SpoolMaxSize * 1024 * 1024
+		sp, err := mistral.NewSpool(
+			conf.Mistral.SpoolPath,
+			segSize,
+			maxSize,
+			time.Duration(conf.Mistral.SpoolMaxAge)*time.Minute,
+		)
+		if err != nil {
+			logrus.Fatalf("Unable to open spool: %s", err)
+		}
+		mistral.Spooler = sp
+		waitdelay.Use()
+		go func() {
+			defer waitdelay.Done()
+			defer close(replayDone)
+			sp.Replay()
+		}()
+		logrus.Infof("Launched disk spool replay from %s",
+			conf.Mistral.SpoolPath)
+	}
+
+	// setup optional dead letter destination for rejected payloads
+	var dlProducer sarama.SyncProducer
+	switch {
+	case conf.Mistral.DeadLetterTopic != ``:
+		brokers, err := mistral.Brokers(&conf)
+		if err != nil {
+			logrus.Fatalf("Unable to find Kafka brokers: %s", err)
+		}
+		config, err := mistral.ProducerConfig(&conf)
+		if err != nil {
+			logrus.Fatalf("Unable to configure dead letter producer: %s", err)
+		}
+		if dlProducer, err = sarama.NewSyncProducer(brokers, config); err != nil {
+			logrus.Fatalf("Unable to start dead letter producer: %s", err)
+		}
+		mistral.DeadLetter = mistral.NewDeadLetterTopic(dlProducer,
+			conf.Mistral.DeadLetterTopic)
+		logrus.Infof("Writing dead letters to topic %s",
+			conf.Mistral.DeadLetterTopic)
+	case conf.Mistral.DeadLetterFile != ``:
+		dfh, err := reopen.NewFileWriter(
+			filepath.Join(conf.Log.Path, conf.Mistral.DeadLetterFile),
+		)
+		if err != nil {
+			logrus.Fatalf("Unable to open dead letter file: %s", err)
+		}
+		mistral.DeadLetter = mistral.NewDeadLetterFile(dfh)
+		if conf.Log.Rotate {
+			sigChanDeadLetter := make(chan os.Signal, 1)
+			signal.Notify(sigChanDeadLetter, syscall.SIGUSR2)
+			go func() {
+				for range sigChanDeadLetter {
+					if err := dfh.Reopen(); err != nil {
+						logrus.Errorf("Failed to reopen dead letter file: %s", err)
+					}
+				}
+			}()
+		}
+		logrus.Infof("Writing dead letters to %s",
+			filepath.Join(conf.Log.Path, conf.Mistral.DeadLetterFile))
+	}
+
 	// assemble listen address
 	listenURL := &url.URL{}
 	switch conf.Mistral.ListenScheme {
@@ -160,24 +278,205 @@ func main() {
 		conf.Mistral.ListenPort,
 	)
 
+	// suppress batches that are submitted repeatedly
+	if conf.Mistral.IdempotencyCacheSize > 0 {
+		var ttl time.Duration
+		switch conf.Mistral.IdempotencyTTL {
+		case 0:
+			ttl = 5 * time.Minute
+		default:
+			ttl = time.Duration(conf.Mistral.IdempotencyTTL) * time.Second
+		}
+		mistral.Idempotency = mistral.NewIdempotencyCache(
+			conf.Mistral.IdempotencyCacheSize, ttl)
+	}
+
+	// limit the size of decompressed request bodies
+	if conf.Mistral.MaxDecompressedSize > 0 {
+		mistral.MaxDecompressedSize = conf.Mistral.MaxDecompressedSize *
+			1024 * 1024
+	}
+
 	// setup http routes
 	router := httprouter.New()
 	router.GET(`/health`, mistral.Health)
+	router.GET(`/metrics`, mistral.Metrics)
 
 	// check if authentication is required
+	authenticate := func(h httprouter.Handle) httprouter.Handle {
+		return h
+	}
 	switch conf.Mistral.Authentication {
 	case `static_basic_auth`:
 		basicAuthUsername = conf.BasicAuth.Username
 		basicAuthPassword = conf.BasicAuth.Password
-		router.POST(conf.Mistral.EndpointPath, BasicAuth(mistral.Endpoint))
+		authenticate = BasicAuth
+	case `htpasswd`:
+		var err error
+		if htpasswd, err = newHtpasswdFile(conf.BasicAuth.HtpasswdFile); err != nil {
+			logrus.Fatalf("Unable to read htpasswd file: %s", err)
+		}
+		// reload the htpasswd file on HUP or if it changes
+		sigChanReload := make(chan os.Signal, 1)
+		signal.Notify(sigChanReload, syscall.SIGHUP)
+		go watchFile(conf.BasicAuth.HtpasswdFile, `htpasswd file`,
+			sigChanReload, htpasswd.load)
+		authenticate = HtpasswdAuth
+	case `jwt`:
+		// tokens the key set owner issued for other services must not
+		// be accepted
+		if conf.JWT.Issuer == `` || conf.JWT.Audience == `` {
+			logrus.Fatalln(`Authentication jwt requires jwt.issuer and jwt.audience`)
+		}
+		var err error
+		if jwks, err = newJWKSFile(conf.JWT.JWKSFile); err != nil {
+			logrus.Fatalf("Unable to read JWKS file: %s", err)
+		}
+		jwtIssuer = conf.JWT.Issuer
+		jwtAudience = conf.JWT.Audience
+		jwtHostIDClaim = conf.JWT.HostIDClaim
+		// reload the key set on HUP or if it changes
+		sigChanReload := make(chan os.Signal, 1)
+		signal.Notify(sigChanReload, syscall.SIGHUP)
+		go watchFile(conf.JWT.JWKSFile, `JWKS file`,
+			sigChanReload, jwks.load)
+		authenticate = JWTAuth
+	case `hmac`:
+		keys, err := mistral.NewKeyFile(conf.HMAC.KeyFile)
+		if err != nil {
+			logrus.Fatalf("Unable to read HMAC key file: %s", err)
+		}
+		mistral.HostKeys = keys
+		if conf.HMAC.Window > 0 {
+			mistral.SignatureWindow = time.Duration(conf.HMAC.Window) *
+				time.Second
+		}
+		// reload the key file on HUP
+		sigChanReload := make(chan os.Signal, 1)
+		signal.Notify(sigChanReload, syscall.SIGHUP)
+		go func() {
+			for range sigChanReload {
+				if err := keys.Reload(); err != nil {
+					logrus.Errorf("Failed to reload HMAC key file: %s", err)
+				}
+			}
+		}()
+		authenticate = HMACAuth
+	case `mtls`:
+		if listenURL.Scheme != `https` {
+			logrus.Fatalln(`Authentication mtls requires listen.scheme https`)
+		}
+		if err := validClientCertBinding(conf.TLS.ClientHostIDBinding); err != nil {
+			logrus.Fatalln(err)
+		}
+		clientCertBinding = conf.TLS.ClientHostIDBinding
+		clientCertPrefix = conf.TLS.ClientHostIDPrefix
+		authenticate = ClientCertAuth
+	}
+	// restrict the HostIDs every principal may submit
+	if conf.Mistral.AuthorizationRules != `` {
+		rules, err := mistral.NewRules(conf.Mistral.AuthorizationRules)
+		if err != nil {
+			logrus.Fatalf("Unable to read authorization rules: %s", err)
+		}
+		mistral.Authorizer = rules
+
+		// reload the rules on HUP
+		sigChanRules := make(chan os.Signal, 1)
+		signal.Notify(sigChanRules, syscall.SIGHUP)
+		go func() {
+			for range sigChanRules {
+				if err := rules.Reload(); err != nil {
+					logrus.Errorf("Failed to reload authorization rules: %s", err)
+				}
+			}
+		}()
+	}
+
+	// endpoints configured for asynchronous delivery answer before
+	// the Kafka result is known. All data endpoints are authenticated,
+	// timed and logged.
+	accept := func(async bool, h httprouter.Handle) httprouter.Handle {
+		if async {
+			h = mistral.Async(h)
+		}
+		return mistral.Logged(mistral.Timed(authenticate(h)))
+	}
+	router.POST(conf.Mistral.EndpointPath,
+		accept(conf.Mistral.EndpointAsync, mistral.Endpoint))
+
+	// optional Prometheus remote_write endpoint
+	if conf.Mistral.RemoteWritePath != `` {
+		if conf.Mistral.RemoteWriteHostLabel != `` {
+			mistral.RemoteWriteHostLabel = conf.Mistral.RemoteWriteHostLabel
+		}
+		router.POST(conf.Mistral.RemoteWritePath,
+			accept(conf.Mistral.RemoteWriteAsync, mistral.RemoteWrite))
+	}
+
+	// optional InfluxDB line protocol endpoint
+	if conf.Mistral.LineProtocolPath != `` {
+		if conf.Mistral.LineProtocolHostTag != `` {
+			mistral.LineProtocolHostTag = conf.Mistral.LineProtocolHostTag
+		}
+		router.POST(conf.Mistral.LineProtocolPath,
+			accept(conf.Mistral.LineProtocolAsync, mistral.LineProtocol))
+	}
+
+	// limit the size of request bodies as received
+	switch conf.Mistral.MaxBodySize {
+	case 0:
+		mistral.MaxBodySize = 32 * 1024 * 1024
 	default:
-		router.POST(conf.Mistral.EndpointPath, mistral.Endpoint)
+		mistral.MaxBodySize = conf.Mistral.MaxBodySize * 1024 * 1024
 	}
 
 	// setup HTTPserver
 	srv := &http.Server{
-		Addr:    listenURL.Host,
-		Handler: router,
+		Addr:        listenURL.Host,
+		Handler:     mistral.Tracked(router),
+		ConnState:   mistral.ConnState,
+		ConnContext: mistral.ConnContext,
+	}
+
+	// set timeouts and limits of the HTTPserver
+	switch conf.Mistral.ReadHeaderTimeout {
+	case 0:
+		srv.ReadHeaderTimeout = 10 * time.Second
+	default:
+		srv.ReadHeaderTimeout = time.Duration(
+			conf.Mistral.ReadHeaderTimeout,
+		) * time.Millisecond
+	}
+	switch conf.Mistral.ReadTimeout {
+	case 0:
+		srv.ReadTimeout = 60 * time.Second
+	default:
+		srv.ReadTimeout = time.Duration(
+			conf.Mistral.ReadTimeout,
+		) * time.Millisecond
+	}
+	switch conf.Mistral.WriteTimeout {
+	case 0:
+		srv.WriteTimeout = 60 * time.Second
+	default:
+		srv.WriteTimeout = time.Duration(
+			conf.Mistral.WriteTimeout,
+		) * time.Millisecond
+	}
+	switch conf.Mistral.IdleTimeout {
+	case 0:
+		srv.IdleTimeout = 120 * time.Second
+	default:
+		srv.IdleTimeout = time.Duration(
+			conf.Mistral.IdleTimeout,
+		) * time.Millisecond
+	}
+	switch conf.Mistral.MaxHeaderBytes {
+	case 0:
+		srv.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	default:
+		srv.MaxHeaderBytes = conf.Mistral.MaxHeaderBytes
 	}
 
 	// setup TLS configuration if required
@@ -249,6 +548,32 @@ func main() {
 				logrus.Fatalf("Failed to load RootCA from %s", conf.TLS.RootCAs[i])
 			}
 		}
+
+		// verify client certificates against the configured client
+		// CAs. They are requested but not required during the
+		// handshake, so that health checks and metric scrapes work
+		// without one. ClientCertAuth requires them on the data
+		// endpoints.
+		if conf.Mistral.Authentication == `mtls` {
+			cas, err := loadClientCAs(conf.TLS.ClientCAs)
+			if err != nil {
+				logrus.Fatalf("Failed to load ClientCA: %s", err)
+			}
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			srv.TLSConfig.ClientCAs = x509.NewCertPool()
+			for _, ca := range cas {
+				srv.TLSConfig.ClientCAs.AddCert(ca)
+			}
+
+			// optionally reject revoked client certificates
+			if len(conf.TLS.CRLFiles) > 0 {
+				crls, err := loadCRLs(conf.TLS.CRLFiles, cas)
+				if err != nil {
+					logrus.Fatalf("Failed to load CRL: %s", err)
+				}
+				srv.TLSConfig.VerifyPeerCertificate = checkCRLs(crls)
+			}
+		}
 	}
 
 	// delay a bit, then check for early startup errors by the
@@ -335,6 +660,12 @@ runloop:
 
 	// close all handlers
 	close(ms.Shutdown)
+	if mistral.Spooler != nil {
+		// the replay still sends to the handler input channels until
+		// it returns
+		close(mistral.Spooler.Shutdown)
+		<-replayDone
+	}
 	for i := range mistral.Handlers {
 		close(mistral.Handlers[i].ShutdownChannel())
 		close(mistral.Handlers[i].InputChannel())
@@ -369,6 +700,12 @@ drainloop:
 	logrus.Infoln(`Waiting for go-routines to exit`)
 	waitdelay.Wait()
 
+	if dlProducer != nil {
+		if err := dlProducer.Close(); err != nil {
+			logrus.Warnf("Dead letter producer shutdown error: %s", err.Error())
+		}
+	}
+
 	logrus.Infoln(`MISTRAL shutdown complete`)
 	if fault {
 		os.Exit(1)
@@ -0,0 +1,49 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/mistral/cmd/mistral"
+
+import (
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// watchFile calls load on signals received via sigChan or if the
+// modification time of the file at path changed. If load fails, the
+// caller keeps the current content. name describes the file in log
+// messages.
+func watchFile(path, name string, sigChan chan os.Signal, load func() error) {
+	var mtime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		mtime = fi.ModTime()
+	}
+
+	tock := time.NewTicker(5 * time.Second)
+	for {
+		select {
+		case <-sigChan:
+		case <-tock.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				logrus.Errorf("Failed to stat %s: %s", name, err)
+				continue
+			}
+			if fi.ModTime().Equal(mtime) {
+				continue
+			}
+			mtime = fi.ModTime()
+		}
+		if err := load(); err != nil {
+			logrus.Errorf("Failed to reload %s: %s", name, err)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,127 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+)
+
+// AccessLog receives one JSON object per request to the data
+// endpoints. The access log is disabled if it is nil.
+var AccessLog io.Writer
+
+// accessEntry is a single access log record
+type accessEntry struct {
+	mux        sync.Mutex
+	Time       time.Time  `json:"time"`
+	RemoteAddr string     `json:"remote_addr"`
+	Method     string     `json:"method"`
+	Path       string     `json:"path"`
+	Principal  string     `json:"principal,omitempty"`
+	HostIDs    []int      `json:"host_ids,omitempty"`
+	BytesIn    int64      `json:"bytes_in"`
+	Status     int        `json:"status"`
+	Latency    float64    `json:"latency_ms"`
+	Receipts   []*Receipt `json:"receipts,omitempty"`
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	entry *accessEntry
+}
+
+// Read reads from the wrapped body and counts the bytes read
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.entry.mux.Lock()
+	c.entry.BytesIn += int64(n)
+	c.entry.mux.Unlock()
+	return n, err
+}
+
+// Logged writes an access log entry for every request to h
+func Logged(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if AccessLog == nil {
+			h(w, r, ps)
+			return
+		}
+
+		entry := &accessEntry{
+			Time:       time.Now().UTC(),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+		}
+		if r.Body != nil {
+			r.Body = &countingReader{ReadCloser: r.Body, entry: entry}
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		ctx := context.WithValue(r.Context(), accessKey, entry)
+		h(sw, r.WithContext(ctx), ps)
+
+		entry.mux.Lock()
+		entry.Status = sw.status
+		entry.Latency = float64(time.Since(entry.Time)) /
+			float64(time.Millisecond)
+		line, err := json.Marshal(entry)
+		entry.mux.Unlock()
+		if err != nil {
+			logrus.Errorf("Failed to encode access log entry: %s", err)
+			return
+		}
+		if _, err = AccessLog.Write(append(line, '\n')); err != nil {
+			logrus.Errorf("Failed to write access log: %s", err)
+		}
+	}
+}
+
+// accessEntryOf returns the access log entry of r, if r is logged
+func accessEntryOf(r *http.Request) *accessEntry {
+	entry, _ := r.Context().Value(accessKey).(*accessEntry)
+	return entry
+}
+
+// logPrincipal records the authenticated principal of r
+func logPrincipal(r *http.Request, principal string) {
+	if entry := accessEntryOf(r); entry != nil {
+		entry.mux.Lock()
+		entry.Principal = principal
+		entry.mux.Unlock()
+	}
+}
+
+// logHostID records a HostID submitted via r
+func logHostID(r *http.Request, hostID int) {
+	if entry := accessEntryOf(r); entry != nil {
+		entry.mux.Lock()
+		entry.HostIDs = append(entry.HostIDs, hostID)
+		entry.mux.Unlock()
+	}
+}
+
+// logReceipt records where a batch submitted via r was written to
+func logReceipt(r *http.Request, rcpt *Receipt) {
+	if entry := accessEntryOf(r); entry != nil && rcpt != nil {
+		entry.mux.Lock()
+		entry.Receipts = append(entry.Receipts, rcpt)
+		entry.mux.Unlock()
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,98 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Async switches the endpoint h to asynchronous delivery. Requests
+// are answered with 202 Accepted as soon as their batches are queued
+// for an application handler or written to the disk spool, without
+// waiting for the Kafka result.
+func Async(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx := context.WithValue(r.Context(), asyncKey, true)
+		h(w, r.WithContext(ctx), ps)
+	}
+}
+
+// isAsync returns true if r was received via an Async endpoint
+func isAsync(r *http.Request) bool {
+	async, _ := r.Context().Value(asyncKey).(bool)
+	return async
+}
+
+// deliverAsync queues data for the application handler of hostID
+// and returns without waiting for the Kafka result
+func deliverAsync(r *http.Request, hostID int, data []byte) int {
+	ret := make(chan error)
+	if _, err := dispatchRequest(r, erebos.Transport{
+		HostID: hostID,
+		Value:  data,
+		Return: ret,
+	}); err != nil {
+		logrus.Warningf("Could not queue data for HostID %d from %s: %s",
+			hostID, r.RemoteAddr, err.Error())
+		return dispatchStatus(err)
+	}
+
+	go awaitAsync(r.RemoteAddr, hostID, data, ret)
+	return http.StatusAccepted
+}
+
+// awaitAsync waits for the Kafka result of an asynchronously
+// delivered batch. Failed batches are written to the disk spool if
+// one is configured.
+func awaitAsync(remoteAddr string, hostID int, data []byte,
+	ret chan error) {
+
+	res := <-ret
+	if res == nil {
+		logrus.Infof("Processed metric data for HostID %d from %s",
+			hostID, remoteAddr)
+		if MtrReg != nil {
+			metrics.GetOrRegisterMeter(`/async/produced`, *MtrReg).Mark(1)
+		}
+		return
+	}
+
+	logrus.Errorf(
+		"Could not write async data for HostID %d from %s to Kafka: %s",
+		hostID, remoteAddr, res.Error(),
+	)
+	if MtrReg != nil {
+		metrics.GetOrRegisterMeter(`/async/failed`, *MtrReg).Mark(1)
+	}
+
+	if permanentError(res) {
+		deadLetter(res.Error(), remoteAddr, hostID, data)
+		return
+	}
+	if Spooler == nil {
+		return
+	}
+	if err := Spooler.Write(hostID, data); err != nil {
+		logrus.Errorf(
+			"Could not spool async data for HostID %d from %s: %s",
+			hostID, remoteAddr, err.Error(),
+		)
+		return
+	}
+	logrus.Infof("Spooled metric data for HostID %d from %s",
+		hostID, remoteAddr)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,95 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// SetPrincipal returns a copy of r that records principal as the
+// authenticated client identity. It is used by the authentication
+// middlewares.
+func SetPrincipal(r *http.Request, principal string) *http.Request {
+	logPrincipal(r, principal)
+	ctx := context.WithValue(r.Context(), principalKey, principal)
+	return r.WithContext(ctx)
+}
+
+// Principal returns the authenticated client identity of r or an
+// empty string for unauthenticated requests
+func Principal(r *http.Request) string {
+	principal, _ := r.Context().Value(principalKey).(string)
+	return principal
+}
+
+// BindHostIDs returns a copy of r that may only submit batches for
+// the HostIDs in ids. It is used by the authentication middlewares
+// to bind a client identity to its hosts.
+func BindHostIDs(r *http.Request, ids []int) *http.Request {
+	ctx := context.WithValue(r.Context(), hostIDsKey, ids)
+	return r.WithContext(ctx)
+}
+
+// BoundHostIDs returns the HostIDs r is restricted to. It returns
+// false if no HostIDs were bound to r.
+func BoundHostIDs(r *http.Request) ([]int, bool) {
+	ids, ok := r.Context().Value(hostIDsKey).([]int)
+	return ids, ok
+}
+
+// hostIDAllowed returns true if r may submit batches for hostID.
+// The HostIDs bound to the request and the authorization rules for
+// its principal are checked. Signed requests use the principal of
+// the HostID they are signed for, the signature must have been
+// checked with signatureValid before.
+func hostIDAllowed(r *http.Request, hostID int) bool {
+	if ids, ok := BoundHostIDs(r); ok {
+		bound := false
+		for _, id := range ids {
+			if id == hostID {
+				bound = true
+				break
+			}
+		}
+		if !bound {
+			denyHostID(r, hostID, `not bound to client`)
+			return false
+		}
+	}
+
+	if Authorizer != nil && !Authorizer.Allowed(principalFor(r, hostID), hostID) {
+		denyHostID(r, hostID, `not authorized`)
+		return false
+	}
+	return true
+}
+
+// principalFor returns the principal r submits hostID as. Signed
+// requests are authenticated per HostID.
+func principalFor(r *http.Request, hostID int) string {
+	if principal := Principal(r); principal != `` || !isSigned(r) {
+		return principal
+	}
+	return hostPrincipal(hostID)
+}
+
+// denyHostID logs and counts a denied HostID
+func denyHostID(r *http.Request, hostID int, reason string) {
+	logrus.Warningf("Rejected HostID %d from %s (principal %s): %s",
+		hostID, r.RemoteAddr, principalFor(r, hostID), reason)
+	if MtrReg != nil {
+		metrics.GetOrRegisterMeter(`/authorization/denied`, *MtrReg).Mark(1)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,141 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Authorizer holds the HostID authorization rules. If it is nil,
+// authenticated clients may submit any HostID.
+var Authorizer *Rules
+
+// Rules maps principals to the HostIDs they may submit. Principals
+// are the names recorded via SetPrincipal, for example user:alice
+// or subject:CN=agent01,O=Example. Signed requests use host:<HostID>
+// of the HostID they are signed for. Unauthenticated requests use
+// the principal anonymous.
+type Rules struct {
+	path  string
+	mux   sync.RWMutex
+	rules map[string][]hostRange
+}
+
+// hostRange is an inclusive range of HostIDs
+type hostRange struct {
+	from int
+	to   int
+}
+
+// NewRules reads the authorization rules from path. Every line holds
+// a principal followed by a comma separated list of HostIDs and
+// HostID ranges, or * for all HostIDs:
+//
+//	user:alice 1-100,205
+//	subject:CN=agent01,O=Example 42
+func NewRules(path string) (*Rules, error) {
+	ru := &Rules{
+		path:  path,
+		rules: make(map[string][]hostRange),
+	}
+	return ru, ru.Reload()
+}
+
+// Reload reads the rules file again. The current rules stay active
+// if it can not be parsed.
+func (ru *Rules) Reload() error {
+	fh, err := os.Open(ru.path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	rules := make(map[string][]hostRange)
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == `` || strings.HasPrefix(text, `#`) {
+			continue
+		}
+
+		// principals may contain spaces, the HostID list is the
+		// last field
+		split := strings.LastIndexAny(text, " \t")
+		if split < 0 {
+			return fmt.Errorf("%s:%d: missing HostIDs", ru.path, line)
+		}
+		principal := strings.TrimSpace(text[:split])
+		ranges, err := parseHostRanges(text[split+1:])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", ru.path, line, err)
+		}
+		rules[principal] = append(rules[principal], ranges...)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	ru.mux.Lock()
+	ru.rules = rules
+	ru.mux.Unlock()
+	logrus.Infof("Loaded authorization rules for %d principals from %s",
+		len(rules), ru.path)
+	return nil
+}
+
+// Allowed returns true if principal may submit hostID
+func (ru *Rules) Allowed(principal string, hostID int) bool {
+	if principal == `` {
+		principal = `anonymous`
+	}
+
+	ru.mux.RLock()
+	defer ru.mux.RUnlock()
+	for _, rng := range ru.rules[principal] {
+		if hostID >= rng.from && hostID <= rng.to {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostRanges parses a comma separated list of HostIDs and
+// HostID ranges
+func parseHostRanges(list string) ([]hostRange, error) {
+	ranges := []hostRange{}
+	for _, item := range strings.Split(list, `,`) {
+		if item == `*` {
+			ranges = append(ranges, hostRange{from: 1, to: int(^uint(0) >> 1)})
+			continue
+		}
+
+		bounds := strings.SplitN(item, `-`, 2)
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid HostID: %s", item)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(bounds[1]); err != nil || to < from {
+				return nil, fmt.Errorf("invalid HostID range: %s", item)
+			}
+		}
+		ranges = append(ranges, hostRange{from: from, to: to})
+	}
+	return ranges, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
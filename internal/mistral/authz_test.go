@@ -0,0 +1,158 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeRules writes the authorization rules file at path
+func writeRules(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path,
+		[]byte(strings.Join(lines, "\n")+"\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testRules returns the Rules read from a file with lines
+func testRules(t *testing.T, lines ...string) *Rules {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `mistral-authz`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, `rules`)
+	writeRules(t, path, lines...)
+	ru, err := NewRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ru
+}
+
+func TestParseHostRanges(t *testing.T) {
+	maxInt := int(^uint(0) >> 1)
+
+	tests := []struct {
+		list string
+		want []hostRange
+	}{
+		{`42`, []hostRange{{42, 42}}},
+		{`1-100,205`, []hostRange{{1, 100}, {205, 205}}},
+		{`7-7`, []hostRange{{7, 7}}},
+		{`*`, []hostRange{{1, maxInt}}},
+		{`1-10,5-20`, []hostRange{{1, 10}, {5, 20}}},
+	}
+	for _, tt := range tests {
+		got, err := parseHostRanges(tt.list)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parsed %v, expected %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestParseHostRangesMalformed(t *testing.T) {
+	tests := []struct {
+		list string
+		err  string
+	}{
+		{``, `invalid HostID`},
+		{`abc`, `invalid HostID`},
+		{`1,,2`, `invalid HostID`},
+		{`-5`, `invalid HostID`},
+		{`10-5`, `invalid HostID range`},
+		{`1-x`, `invalid HostID range`},
+		{`1-2-3`, `invalid HostID range`},
+		{`**`, `invalid HostID`},
+	}
+	for _, tt := range tests {
+		_, err := parseHostRanges(tt.list)
+		if err == nil {
+			t.Errorf("%s: expected error %q", tt.list, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %q, expected %q", tt.list, err, tt.err)
+		}
+	}
+}
+
+func TestRulesAllowed(t *testing.T) {
+	ru := testRules(t,
+		`# comment`,
+		``,
+		`user:alice 1-100,205`,
+		`user:alice 90-150`,
+		`user:admin *`,
+		`subject:CN=agent 01,O=Example 42`,
+		`anonymous 7`,
+	)
+
+	tests := []struct {
+		principal string
+		hostID    int
+		allowed   bool
+	}{
+		{`user:alice`, 1, true},
+		{`user:alice`, 100, true},
+		{`user:alice`, 150, true},
+		{`user:alice`, 151, false},
+		{`user:alice`, 205, true},
+		{`user:alice`, 0, false},
+		{`user:admin`, 1, true},
+		{`user:admin`, 2147483647, true},
+		{`subject:CN=agent 01,O=Example`, 42, true},
+		{`subject:CN=agent 01,O=Example`, 43, false},
+		{``, 7, true},
+		{``, 8, false},
+		{`anonymous`, 7, true},
+		{`user:mallory`, 1, false},
+	}
+	for _, tt := range tests {
+		if got := ru.Allowed(tt.principal, tt.hostID); got != tt.allowed {
+			t.Errorf("principal %q, HostID %d: %t, expected %t",
+				tt.principal, tt.hostID, got, tt.allowed)
+		}
+	}
+}
+
+func TestRulesReload(t *testing.T) {
+	ru := testRules(t, `user:alice 1`)
+
+	writeRules(t, ru.path, `user:bob 2`)
+	if err := ru.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if ru.Allowed(`user:alice`, 1) || !ru.Allowed(`user:bob`, 2) {
+		t.Error(`reloaded rules are not active`)
+	}
+
+	// the current rules stay active if the file is invalid
+	writeRules(t, ru.path, `user:carol`)
+	if err := ru.Reload(); err == nil {
+		t.Error(`invalid rules were loaded`)
+	}
+	if !ru.Allowed(`user:bob`, 2) {
+		t.Error(`rules were dropped after a failed reload`)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,97 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// EnqueueTimeout is how long a request waits for room in the input
+// queue of its application handler
+var EnqueueTimeout = time.Second
+
+// ErrQueueFull is returned if the input queue of an application
+// handler stayed full for EnqueueTimeout
+var ErrQueueFull = errors.New(`mistral: handler queue full`)
+
+// dispatchRequest queues msg for its application handler like
+// Dispatch, but gives up after EnqueueTimeout or once the request r
+// is canceled. Unless r was received via an Async endpoint, the batch
+// is dropped if the client disconnects while it is queued and its
+// Receipt is filled in the returned state.
+func dispatchRequest(r *http.Request, msg erebos.Transport) (*requestState, error) {
+	st := &requestState{}
+	if !isAsync(r) {
+		st.ctx = r.Context()
+		st.receipt = &Receipt{}
+	}
+	trackRequest(msg.Return, st)
+
+	timeout := time.NewTimer(EnqueueTimeout)
+	defer timeout.Stop()
+
+	select {
+	case Handlers[shard(msg.HostID, len(Handlers))].InputChannel() <- &msg:
+		return st, nil
+	case <-r.Context().Done():
+		untrackRequest(msg.Return)
+		if MtrReg != nil {
+			metrics.GetOrRegisterMeter(`/aborted`, *MtrReg).Mark(1)
+		}
+		return nil, r.Context().Err()
+	case <-timeout.C:
+		untrackRequest(msg.Return)
+		if MtrReg != nil {
+			metrics.GetOrRegisterMeter(`/rejected/queue_full`, *MtrReg).Mark(1)
+		}
+		return nil, ErrQueueFull
+	}
+}
+
+// dispatchStatus returns the HTTP status code for a failed
+// dispatchRequest
+func dispatchStatus(err error) int {
+	if err == ErrQueueFull {
+		return http.StatusTooManyRequests
+	}
+	// the client is gone
+	return http.StatusRequestTimeout
+}
+
+// setRetryAfter sets the Retry-After header for a request rejected
+// with 429 Too Many Requests. The delay is the time the handlers
+// need to work off their queues at the current message rate.
+func setRetryAfter(w http.ResponseWriter) {
+	depth := 0
+	for _, h := range Handlers {
+		depth += len(h.InputChannel())
+	}
+
+	seconds := 1.0
+	if MtrReg != nil && depth > 0 {
+		rate := metrics.GetOrRegisterMeter(`/messages`, *MtrReg).Rate1()
+		switch {
+		case rate > 0:
+			seconds = math.Ceil(float64(depth) / rate)
+		default:
+			seconds = 60
+		}
+	}
+	seconds = math.Max(1, math.Min(seconds, 60))
+	w.Header().Set(`Retry-After`, strconv.Itoa(int(seconds)))
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
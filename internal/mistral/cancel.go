@@ -0,0 +1,38 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"errors"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// ErrAborted is returned for batches that were not produced because
+// the client disconnected while they were queued
+var ErrAborted = errors.New(`mistral: client disconnected`)
+
+// aborted returns true if the client that submitted msg with the
+// state st is gone. The client request is acknowledged with
+// ErrAborted.
+func (m *Mistral) aborted(msg *erebos.Transport, st *requestState) bool {
+	if st == nil || st.ctx == nil || st.ctx.Err() == nil {
+		return false
+	}
+
+	logrus.Infof("Mistral[%d]: dropped batch for HostID %d, client disconnected",
+		m.Num, msg.HostID)
+	metrics.GetOrRegisterMeter(`/aborted`, *m.Metrics).Mark(1)
+	m.reply(msg, ErrAborted)
+	return true
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
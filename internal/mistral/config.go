@@ -0,0 +1,151 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/mjolnir42/erebos"
+	ucl "github.com/nahanni/go-ucl"
+)
+
+// Config is the mistral configuration. The log, zookeeper, misc and
+// legacy sections are shared with the other erebos applications and
+// read into the embedded erebos.Config. The sections below replace
+// their erebos counterparts, since they carry mistral specific
+// settings.
+type Config struct {
+	erebos.Config
+	Kafka struct {
+		Brokers                  []string `json:"brokers"`
+		ProducerTopic            string   `json:"producer.topic"`
+		ProducerResponseStrategy string   `json:"producer.response.strategy"`
+		ProducerRetry            int      `json:"producer.retry.attempts,string"`
+		Keepalive                int64    `json:"keepalive.ms,string"`
+		ProducerRetryBackoff     int64    `json:"producer.retry.backoff.ms,string"`
+		Version                  string   `json:"version"`
+		ProducerCompression      string   `json:"producer.compression.codec"`
+		ProducerCompressionLevel int      `json:"producer.compression.level,string"`
+		ProducerFlushBytes       int      `json:"producer.flush.bytes,string"`
+		ProducerFlushMessages    int      `json:"producer.flush.messages,string"`
+		ProducerFlushFrequency   int64    `json:"producer.flush.frequency.ms,string"`
+		ProducerMaxMessageBytes  int      `json:"producer.max.message.bytes,string"`
+		ProducerIdempotent       bool     `json:"producer.idempotent,string"`
+		ProducerTransactional    bool     `json:"producer.transactional,string"`
+		SASLMechanism            string   `json:"sasl.mechanism"`
+		SASLUsername             string   `json:"sasl.username"`
+		SASLPassword             string   `json:"sasl.password"`
+		TLS                      bool     `json:"tls.enabled,string"`
+		TLSCAFile                string   `json:"tls.ca.file"`
+		TLSCertFile              string   `json:"tls.cert.file"`
+		TLSKeyFile               string   `json:"tls.key.file"`
+		TLSServerName            string   `json:"tls.server.name"`
+	} `json:"kafka"`
+	Mistral struct {
+		HandlerQueueLength   int    `json:"handler.queue.length,string"`
+		ListenAddress        string `json:"listen.address"`
+		ListenPort           string `json:"listen.port"`
+		ListenScheme         string `json:"listen.scheme"`
+		EndpointPath         string `json:"api.endpoint.path"`
+		Authentication       string `json:"authentication.style"`
+		RemoteWritePath      string `json:"remote.write.path"`
+		RemoteWriteHostLabel string `json:"remote.write.hostid.label"`
+		LineProtocolPath     string `json:"line.protocol.path"`
+		LineProtocolHostTag  string `json:"line.protocol.hostid.tag"`
+		EndpointAsync        bool   `json:"api.endpoint.async,string"`
+		RemoteWriteAsync     bool   `json:"remote.write.async,string"`
+		LineProtocolAsync    bool   `json:"line.protocol.async,string"`
+		MaxDecompressedSize  int64  `json:"max.decompressed.size.mb,string"`
+		MaxBodySize          int64  `json:"max.body.size.mb,string"`
+		MaxHeaderBytes       int    `json:"max.header.bytes,string"`
+		ReadHeaderTimeout    int64  `json:"read.header.timeout.ms,string"`
+		ReadTimeout          int64  `json:"read.timeout.ms,string"`
+		WriteTimeout         int64  `json:"write.timeout.ms,string"`
+		IdleTimeout          int64  `json:"idle.timeout.ms,string"`
+		AuthorizationRules   string `json:"authorization.rules.file"`
+		AccessLogFile        string `json:"access.log.file"`
+		HandlerCount         int    `json:"handler.count,string"`
+		HandlerSharding      string `json:"handler.sharding"`
+		EnqueueTimeout       int64  `json:"handler.enqueue.timeout.ms,string"`
+		IdempotencyCacheSize int    `json:"idempotency.cache.size,string"`
+		IdempotencyTTL       int64  `json:"idempotency.ttl.seconds,string"`
+		DeadLetterTopic      string `json:"deadletter.topic"`
+		DeadLetterFile       string `json:"deadletter.file"`
+		SpoolPath            string `json:"spool.path"`
+		SpoolSegmentSize     int64  `json:"spool.segment.size.mb,string"`
+		SpoolMaxSize         int64  `json:"spool.max.size.mb,string"`
+		SpoolMaxAge          int64  `json:"spool.max.age.minutes,string"`
+	} `json:"mistral"`
+	BasicAuth struct {
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		HtpasswdFile string `json:"htpasswd.file"`
+	} `json:"basicauth"`
+	JWT struct {
+		JWKSFile    string `json:"jwks.file"`
+		Issuer      string `json:"issuer"`
+		Audience    string `json:"audience"`
+		HostIDClaim string `json:"hostid.claim"`
+	} `json:"jwt"`
+	HMAC struct {
+		KeyFile string `json:"key.file"`
+		Window  int64  `json:"replay.window.seconds,string"`
+	} `json:"hmac"`
+	TLS struct {
+		CertificateChains []struct {
+			ChainFile string `json:"certificate.chain.file"`
+			KeyFile   string `json:"certificate.key.file"`
+		} `json:"certificate.chains"`
+		RootCAs             []string `json:"root.ca.files"`
+		MinVersion          string   `json:"min.version"`
+		MaxVersion          string   `json:"max.version"`
+		Ciphers             string   `json:"cipher.style"`
+		ClientCAs           []string `json:"client.ca.files"`
+		CRLFiles            []string `json:"crl.files"`
+		ClientHostIDBinding string   `json:"client.hostid.binding"`
+		ClientHostIDPrefix  string   `json:"client.hostid.prefix"`
+	} `json:"tls"`
+}
+
+// FromFile sets Config c based on the file contents. The embedded
+// erebos.Config is read by erebos, the mistral sections are read
+// from the same file afterwards.
+func (c *Config) FromFile(fname string) error {
+	var (
+		file, uclJSON []byte
+		uclData       map[string]interface{}
+		err           error
+	)
+	if err = c.Config.FromFile(fname); err != nil {
+		return err
+	}
+	if fname, err = filepath.Abs(fname); err != nil {
+		return err
+	}
+	if fname, err = filepath.EvalSymlinks(fname); err != nil {
+		return err
+	}
+	if file, err = ioutil.ReadFile(fname); err != nil {
+		return err
+	}
+
+	// take detour via JSON to load UCL into struct
+	if uclData, err = ucl.NewParser(bytes.NewReader(file)).Ucl(); err != nil {
+		return err
+	}
+	if uclJSON, err = json.Marshal(uclData); err != nil {
+		return err
+	}
+	return json.Unmarshal(uclJSON, c)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
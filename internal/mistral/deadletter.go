@@ -0,0 +1,153 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// DeadLetter receives payloads that were rejected or could not be
+// produced. It is disabled if nil.
+var DeadLetter DeadLetterSink
+
+// DeadLetterSink stores rejected payloads for later investigation
+type DeadLetterSink interface {
+	Write(rec *DeadLetterRecord) error
+}
+
+// DeadLetterRecord is a rejected payload and the reason it was
+// rejected for
+type DeadLetterRecord struct {
+	Time       time.Time `json:"time"`
+	Reason     string    `json:"reason"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	HostID     int       `json:"host_id,omitempty"`
+	Body       []byte    `json:"body"`
+}
+
+// deadLetterFile writes dead letters as JSON objects, one per line
+type deadLetterFile struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+// deadLetterTopic produces dead letters to a Kafka topic
+type deadLetterTopic struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+// NewDeadLetterFile returns a DeadLetterSink that writes to w. The
+// body is base64 encoded.
+func NewDeadLetterFile(w io.Writer) DeadLetterSink {
+	return &deadLetterFile{w: w}
+}
+
+// NewDeadLetterTopic returns a DeadLetterSink that produces to topic.
+// The body is the message value, the other fields are sent as
+// message headers.
+func NewDeadLetterTopic(producer sarama.SyncProducer, topic string) DeadLetterSink {
+	return &deadLetterTopic{producer: producer, topic: topic}
+}
+
+// Write implements DeadLetterSink
+func (d *deadLetterFile) Write(rec *DeadLetterRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	_, err = d.w.Write(append(line, '\n'))
+	return err
+}
+
+// Write implements DeadLetterSink
+func (d *deadLetterTopic) Write(rec *DeadLetterRecord) error {
+	msg := &sarama.ProducerMessage{
+		Topic: d.topic,
+		Value: sarama.ByteEncoder(rec.Body),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(`reason`), Value: []byte(rec.Reason)},
+			{Key: []byte(`remote_addr`), Value: []byte(rec.RemoteAddr)},
+			{Key: []byte(`timestamp`), Value: []byte(rec.Time.Format(time.RFC3339Nano))},
+		},
+	}
+	if rec.HostID != 0 {
+		msg.Key = sarama.StringEncoder(strconv.Itoa(rec.HostID))
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{
+			Key:   []byte(`host_id`),
+			Value: []byte(strconv.Itoa(rec.HostID)),
+		})
+	}
+	_, _, err := d.producer.SendMessage(msg)
+	return err
+}
+
+// deadLetter hands a rejected payload to the DeadLetter sink
+func deadLetter(reason, remoteAddr string, hostID int, body []byte) {
+	if DeadLetter == nil {
+		return
+	}
+	if err := DeadLetter.Write(&DeadLetterRecord{
+		Time:       time.Now().UTC(),
+		Reason:     reason,
+		RemoteAddr: remoteAddr,
+		HostID:     hostID,
+		Body:       body,
+	}); err != nil {
+		logrus.Errorf("Could not write dead letter from %s: %s",
+			remoteAddr, err.Error())
+		return
+	}
+	if MtrReg != nil {
+		metrics.GetOrRegisterMeter(`/deadletter`, *MtrReg).Mark(1)
+	}
+}
+
+// permanentError returns true if producing failed for a reason that
+// retrying does not fix
+func permanentError(err error) bool {
+	switch err {
+	case sarama.ErrMessageSizeTooLarge,
+		sarama.ErrMessageSetSizeTooLarge,
+		sarama.ErrInvalidMessage,
+		sarama.ErrInvalidMessageSize,
+		sarama.ErrInvalidRecord:
+		return true
+	}
+	// sarama rejects messages exceeding Producer.MaxMessageBytes
+	// before sending them
+	_, ok := err.(sarama.ConfigurationError)
+	return ok
+}
+
+// permanentStatus is the HTTP status code for batches that failed
+// with a permanent error
+func permanentStatus(err error) int {
+	switch err {
+	case sarama.ErrMessageSizeTooLarge, sarama.ErrMessageSetSizeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	}
+	if _, ok := err.(sarama.ConfigurationError); ok {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -9,18 +9,31 @@
 package mistral // import "github.com/solnx/mistral/internal/mistral"
 
 import (
-	"runtime"
-
 	"github.com/mjolnir42/erebos"
 )
 
 // Dispatch implements erebos.Dispatcher
 func Dispatch(msg erebos.Transport) error {
+	trackRequest(msg.Return, &requestState{})
+
 	// send all messages with the same HostID to the same handler
 	// to keep the ordering intact
-
-	Handlers[msg.HostID%runtime.NumCPU()].InputChannel() <- &msg
+	Handlers[shard(msg.HostID, len(Handlers))].InputChannel() <- &msg
 	return nil
 }
 
+// dispatchUntil queues msg like Dispatch, but gives up once done is
+// closed. It returns true if msg was queued.
+func dispatchUntil(msg erebos.Transport, done <-chan struct{}) bool {
+	trackRequest(msg.Return, &requestState{})
+
+	select {
+	case Handlers[shard(msg.HostID, len(Handlers))].InputChannel() <- &msg:
+		return true
+	case <-done:
+		untrackRequest(msg.Return)
+		return false
+	}
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,104 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// MaxDecompressedSize is the maximum size in bytes of a compressed
+// request body after decompression
+var MaxDecompressedSize int64 = 64 * 1024 * 1024
+
+// readBody reads the body of r and decodes it according to its
+// Content-Encoding header. Encodings listed in native are decoded by
+// the endpoint itself and are returned as received. On error, the
+// HTTP status code for the request is returned.
+func readBody(r *http.Request, native ...string) ([]byte, int, error) {
+	encoding := strings.ToLower(strings.TrimSpace(
+		r.Header.Get(`Content-Encoding`)))
+	for _, enc := range native {
+		if encoding == enc {
+			encoding = ``
+		}
+	}
+
+	var body io.Reader
+	switch encoding {
+	case ``, `identity`:
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, readErrorStatus(err), err
+		}
+		return buf, http.StatusOK, nil
+	case `gzip`, `x-gzip`:
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, readErrorStatus(err), err
+		}
+		defer gz.Close()
+		body = gz
+	case `deflate`:
+		// deflate is zlib wrapped according to RFC 7230, but some
+		// clients send raw deflate data
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, readErrorStatus(err), err
+		}
+		zl, err := zlib.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			fl := flate.NewReader(bytes.NewReader(buf))
+			defer fl.Close()
+			body = fl
+			break
+		}
+		defer zl.Close()
+		body = zl
+	case `zstd`:
+		zs, err := zstd.NewReader(r.Body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(MaxDecompressedSize)),
+		)
+		if err != nil {
+			return nil, readErrorStatus(err), err
+		}
+		defer zs.Close()
+		body = zs
+	default:
+		return nil, http.StatusUnsupportedMediaType,
+			fmt.Errorf("Unsupported Content-Encoding: %s", encoding)
+	}
+
+	// read one byte past the limit to detect oversized bodies
+	buf, err := ioutil.ReadAll(io.LimitReader(body, MaxDecompressedSize+1))
+	switch {
+	case err == zstd.ErrDecoderSizeExceeded,
+		err == zstd.ErrWindowSizeExceeded:
+		return nil, http.StatusRequestEntityTooLarge, err
+	case err != nil:
+		return nil, readErrorStatus(err), err
+	case int64(len(buf)) > MaxDecompressedSize:
+		return nil, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("Decompressed body exceeds %d bytes",
+				MaxDecompressedSize)
+	}
+	return buf, http.StatusOK, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -10,8 +10,8 @@ package mistral // import "github.com/solnx/mistral/internal/mistral"
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"net/http"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/julienschmidt/httprouter"
@@ -24,39 +24,18 @@ import (
 func Endpoint(w http.ResponseWriter, r *http.Request,
 	params httprouter.Params) {
 
-	// count all requests, declined or accepted
-	if MtrReg != nil {
-		mtr := metrics.GetOrRegisterMeter(`/requests`, *MtrReg)
-		mtr.Mark(1)
-	}
-
-	// no new requests are served if the service is
-	// considered unavailable
-	if unavailable {
-		logrus.Infof("Unavailable - request from %s rejected", r.RemoteAddr)
-		http.Error(w,
-			http.StatusText(http.StatusServiceUnavailable),
-			http.StatusServiceUnavailable,
-		)
+	buf, ok := readRequest(w, r)
+	if !ok {
 		return
 	}
 
-	if r.Body == nil {
-		logrus.Warningf("Rejected empty request body from %s", r.RemoteAddr)
-		http.Error(w,
-			http.StatusText(http.StatusBadRequest),
-			http.StatusBadRequest,
-		)
-		return
-	}
-	buf, _ := ioutil.ReadAll(r.Body)
-
 	// verify the received data can be parsed
 	batch := &legacy.MetricBatch{}
 	if err := json.Unmarshal(buf, batch); err != nil {
 		logrus.Warningf(
 			"json.Unmarshal: rejected unprocessable data from %s: %s",
 			r.RemoteAddr, err.Error())
+		deadLetter(err.Error(), r.RemoteAddr, 0, buf)
 
 		http.Error(w,
 			err.Error(),
@@ -70,6 +49,7 @@ func Endpoint(w http.ResponseWriter, r *http.Request,
 	if hostID == 0 {
 		logrus.Warningf("Rejected invalid HostID 0 from %s",
 			r.RemoteAddr)
+		deadLetter(`invalid HostID 0`, r.RemoteAddr, 0, buf)
 
 		http.Error(w,
 			http.StatusText(http.StatusBadRequest),
@@ -78,6 +58,28 @@ func Endpoint(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	decoded(r)
+	logHostID(r, hostID)
+
+	// signed requests must carry the signature of the HostID
+	if !signatureValid(r, hostID) {
+		rejectSignature(r, hostID, `invalid signature`)
+		http.Error(w,
+			http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized,
+		)
+		return
+	}
+
+	// the authenticated client may be bound to its own HostIDs
+	if !hostIDAllowed(r, hostID) {
+		http.Error(w,
+			http.StatusText(http.StatusForbidden),
+			http.StatusForbidden,
+		)
+		return
+	}
+
 	// encode back to JSON, this Unmarshal/Marshal step fixes and
 	// converts some broken metrics
 	var err error
@@ -95,32 +97,205 @@ func Endpoint(w http.ResponseWriter, r *http.Request,
 	}
 
 	// send data to application handler for kafka production
+	status, rcpt := deliverOnce(r, hostID, fixed)
+	if status != http.StatusOK && status != http.StatusAccepted {
+		if status == http.StatusTooManyRequests {
+			setRetryAfter(w)
+		}
+		http.Error(w,
+			http.StatusText(status),
+			status,
+		)
+		return
+	}
+
+	// return where the data was written to
+	if rcpt != nil {
+		if body, err := json.Marshal(rcpt); err == nil {
+			w.Header().Set(`Content-Type`, `application/json`)
+			w.WriteHeader(status)
+			w.Write(body)
+			return
+		}
+	}
+
+	w.WriteHeader(status)
+	w.Write(nil)
+}
+
+// readRequest performs the checks common to all data endpoints and
+// returns the decoded request body. Content encodings listed in
+// native are left for the endpoint to decode. If it returns false,
+// the request has already been answered.
+func readRequest(w http.ResponseWriter, r *http.Request,
+	native ...string) ([]byte, bool) {
+
+	// count all requests, declined or accepted
+	if MtrReg != nil {
+		mtr := metrics.GetOrRegisterMeter(`/requests`, *MtrReg)
+		mtr.Mark(1)
+	}
+
+	// no new requests are served if the service is
+	// considered unavailable
+	if unavailable {
+		logrus.Infof("Unavailable - request from %s rejected", r.RemoteAddr)
+		http.Error(w,
+			http.StatusText(http.StatusServiceUnavailable),
+			http.StatusServiceUnavailable,
+		)
+		return nil, false
+	}
+
+	if r.Body == nil {
+		logrus.Warningf("Rejected empty request body from %s", r.RemoteAddr)
+		http.Error(w,
+			http.StatusText(http.StatusBadRequest),
+			http.StatusBadRequest,
+		)
+		return nil, false
+	}
+
+	// limit the size of the body as received
+	if MaxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodySize)
+	}
+
+	buf, status, err := readBody(r, native...)
+	if err != nil {
+		logrus.Warningf("Rejected request body from %s: %s",
+			r.RemoteAddr, err.Error())
+		markRejectedStatus(status)
+		http.Error(w,
+			err.Error(),
+			status,
+		)
+		return nil, false
+	}
+	return buf, true
+}
+
+// deliverBatches sends the batches to the application handlers in
+// parallel and returns the combined HTTP status code for the request.
+// The request fails if any batch failed.
+func deliverBatches(r *http.Request,
+	batches map[int]*legacy.MetricBatch) int {
+
+	// nothing is produced if the client is not permitted to submit
+	// all of the batches
+	for hostID := range batches {
+		logHostID(r, hostID)
+		if !signatureValid(r, hostID) {
+			rejectSignature(r, hostID, `invalid signature`)
+			return http.StatusUnauthorized
+		}
+		if !hostIDAllowed(r, hostID) {
+			return http.StatusForbidden
+		}
+	}
+
+	result := make(chan int, len(batches))
+	wg := sync.WaitGroup{}
+	for hostID, batch := range batches {
+		fixed, err := json.Marshal(batch)
+		if err != nil {
+			logrus.Errorf(
+				"json.Marshal: rejected unprocessable data for HostID %d from %s: %s",
+				hostID, r.RemoteAddr, err.Error())
+			result <- http.StatusUnprocessableEntity
+			continue
+		}
+
+		wg.Add(1)
+		go func(hostID int, data []byte) {
+			defer wg.Done()
+			status, _ := deliverSigned(r, hostID, data)
+			result <- status
+		}(hostID, fixed)
+	}
+	wg.Wait()
+	close(result)
+
+	status := http.StatusOK
+	for res := range result {
+		switch {
+		case res != http.StatusOK && res != http.StatusAccepted:
+			status = res
+		case res == http.StatusAccepted && status == http.StatusOK:
+			status = res
+		}
+	}
+	return status
+}
+
+// deliver sends data to the application handler for hostID and waits
+// for the Kafka result, unless r was received via an Async endpoint.
+// It returns the HTTP status code for the request and, if the data
+// was produced, the Receipt.
+func deliver(r *http.Request, hostID int, data []byte) (int, *Receipt) {
+	// while the disk spool holds batches for hostID that wait for
+	// replay, new batches are spooled as well to keep their ordering
+	if Spooler != nil && Spooler.Engaged(hostID) {
+		return spoolBatch(r, hostID, data), nil
+	}
+
+	if isAsync(r) {
+		return deliverAsync(r, hostID, data), nil
+	}
+
 	ret := make(chan error)
-	Dispatch(erebos.Transport{
+	st, err := dispatchRequest(r, erebos.Transport{
 		HostID: hostID,
-		Value:  fixed,
+		Value:  data,
 		Return: ret,
 	})
+	if err != nil {
+		logrus.Warningf("Could not queue data for HostID %d from %s: %s",
+			hostID, r.RemoteAddr, err.Error())
+		return dispatchStatus(err), nil
+	}
 
 	// wait for kafka result
 	res := <-ret
+	rcpt := st.receipt
+	if res == ErrAborted {
+		// the client is gone and will retry
+		return http.StatusRequestTimeout, nil
+	}
+	logReceipt(r, rcpt)
 	if res != nil {
 		logrus.Errorf(
-			"Could not write data for HostID %d from %s to Kafka: %s",
-			hostID, r.RemoteAddr, res.Error(),
+			"Could not write data for HostID %d from %s to Kafka (tracking ID %s): %s",
+			hostID, r.RemoteAddr, rcpt.TrackingID, res.Error(),
 		)
 
-		http.Error(w,
-			http.StatusText(http.StatusBadGateway),
-			http.StatusBadGateway,
+		if permanentError(res) {
+			deadLetter(res.Error(), r.RemoteAddr, hostID, data)
+			return permanentStatus(res), nil
+		}
+		if Spooler != nil {
+			return spoolBatch(r, hostID, data), nil
+		}
+		return http.StatusBadGateway, nil
+	}
+	logrus.Infof(
+		"Processed metric data for HostID %d from %s (tracking ID %s, partition %d, offset %d)",
+		hostID, r.RemoteAddr, rcpt.TrackingID, rcpt.Partition, rcpt.Offset)
+	return http.StatusOK, rcpt
+}
+
+// spoolBatch writes the batch to the disk spool for later replay
+func spoolBatch(r *http.Request, hostID int, data []byte) int {
+	if err := Spooler.Write(hostID, data); err != nil {
+		logrus.Errorf(
+			"Could not spool data for HostID %d from %s: %s",
+			hostID, r.RemoteAddr, err.Error(),
 		)
-		return
+		return http.StatusBadGateway
 	}
-	logrus.Infof("Processed metric data for HostID %d from %s",
+	logrus.Infof("Spooled metric data for HostID %d from %s",
 		hostID, r.RemoteAddr)
-
-	w.WriteHeader(http.StatusOK)
-	w.Write(nil)
+	return http.StatusAccepted
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -20,17 +20,13 @@ import (
 // via legacy.MetricSocket, implementing legacy.Formatter
 func FormatMetrics(batch *legacy.PluginMetricBatch) func(string, interface{}) {
 	return func(metric string, v interface{}) {
-		switch v.(type) {
-		case *metrics.StandardMeter:
-			value := v.(*metrics.StandardMeter)
+		exportMetric(metric, v, func(name, typ string, value legacy.MetricValue) {
 			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
-				Type:   `float`,
-				Metric: fmt.Sprintf("%s/avg/rate/1min", metric),
-				Value: legacy.MetricValue{
-					FlpVal: value.Rate1(),
-				},
+				Type:   typ,
+				Metric: name,
+				Value:  value,
 			})
-		}
+		})
 	}
 }
 
@@ -38,13 +34,66 @@ func FormatMetrics(batch *legacy.PluginMetricBatch) func(string, interface{}) {
 // on STDERR
 func DebugFormatMetrics(_ *legacy.PluginMetricBatch) func(string, interface{}) {
 	return func(metric string, v interface{}) {
-		switch v.(type) {
-		case *metrics.StandardMeter:
-			value := v.(*metrics.StandardMeter)
-			fmt.Fprintf(os.Stderr, "%s/avg/rate/1min: %f\n",
-				metric, value.Rate1())
+		exportMetric(metric, v, func(name, typ string, value legacy.MetricValue) {
+			switch typ {
+			case `integer`:
+				fmt.Fprintf(os.Stderr, "%s: %d\n", name, value.IntVal)
+			default:
+				fmt.Fprintf(os.Stderr, "%s: %f\n", name, value.FlpVal)
+			}
+		})
+	}
+}
+
+// exportMetric calls emit for every value exported for the go-metrics
+// metric v. Meters export their count and rates, histograms and
+// timers their count, minimum, maximum and percentiles.
+func exportMetric(metric string, v interface{},
+	emit func(string, string, legacy.MetricValue)) {
+
+	integer := func(name string, value int64) {
+		emit(name, `integer`, legacy.MetricValue{IntVal: value})
+	}
+	float := func(name string, value float64) {
+		emit(name, `float`, legacy.MetricValue{FlpVal: value})
+	}
+	rates := func(count int64, r1, r5, r15, mean float64) {
+		integer(fmt.Sprintf("%s/count", metric), count)
+		float(fmt.Sprintf("%s/avg/rate/1min", metric), r1)
+		float(fmt.Sprintf("%s/avg/rate/5min", metric), r5)
+		float(fmt.Sprintf("%s/avg/rate/15min", metric), r15)
+		float(fmt.Sprintf("%s/avg/rate/mean", metric), mean)
+	}
+	distribution := func(count, min, max int64, ps []float64) {
+		integer(fmt.Sprintf("%s/count", metric), count)
+		integer(fmt.Sprintf("%s/min", metric), min)
+		integer(fmt.Sprintf("%s/max", metric), max)
+		for i, p := range percentiles {
+			float(fmt.Sprintf("%s/percentile/%g", metric, p*100), ps[i])
 		}
 	}
+
+	switch value := v.(type) {
+	case metrics.Counter:
+		integer(fmt.Sprintf("%s/count", metric), value.Count())
+	case metrics.Gauge:
+		integer(metric, value.Value())
+	case metrics.GaugeFloat64:
+		float(metric, value.Value())
+	case metrics.Meter:
+		m := value.Snapshot()
+		rates(m.Count(), m.Rate1(), m.Rate5(), m.Rate15(), m.RateMean())
+	case metrics.Histogram:
+		h := value.Snapshot()
+		distribution(h.Count(), h.Min(), h.Max(), h.Percentiles(percentiles))
+	case metrics.Timer:
+		t := value.Snapshot()
+		distribution(t.Count(), t.Min(), t.Max(), t.Percentiles(percentiles))
+		float(fmt.Sprintf("%s/avg/rate/1min", metric), t.Rate1())
+		float(fmt.Sprintf("%s/avg/rate/5min", metric), t.Rate5())
+		float(fmt.Sprintf("%s/avg/rate/15min", metric), t.Rate15())
+		float(fmt.Sprintf("%s/avg/rate/mean", metric), t.RateMean())
+	}
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,159 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+)
+
+// formatted returns the legacy metrics FormatMetrics exports for v,
+// keyed by name
+func formatted(name string, v interface{}) map[string]legacy.PluginMetric {
+	batch := &legacy.PluginMetricBatch{}
+	FormatMetrics(batch)(name, v)
+
+	exported := make(map[string]legacy.PluginMetric)
+	for _, m := range batch.Metrics {
+		exported[m.Metric] = m
+	}
+	return exported
+}
+
+// metricNames returns the names of the exported metrics
+func metricNames(exported map[string]legacy.PluginMetric) map[string]bool {
+	names := make(map[string]bool)
+	for name := range exported {
+		names[name] = true
+	}
+	return names
+}
+
+func TestFormatMetricsScalars(t *testing.T) {
+	counter := metrics.NewCounter()
+	counter.Inc(3)
+	gauge := metrics.NewGauge()
+	gauge.Update(-7)
+	gaugeFloat := metrics.NewGaugeFloat64()
+	gaugeFloat.Update(0.25)
+
+	tests := []struct {
+		name   string
+		metric interface{}
+		want   legacy.PluginMetric
+	}{
+		{`/errors`, counter, legacy.PluginMetric{
+			Metric: `/errors/count`,
+			Type:   `integer`,
+			Value:  legacy.MetricValue{IntVal: 3},
+		}},
+		{`/queue/depth`, gauge, legacy.PluginMetric{
+			Metric: `/queue/depth`,
+			Type:   `integer`,
+			Value:  legacy.MetricValue{IntVal: -7},
+		}},
+		{`/ratio`, gaugeFloat, legacy.PluginMetric{
+			Metric: `/ratio`,
+			Type:   `float`,
+			Value:  legacy.MetricValue{FlpVal: 0.25},
+		}},
+	}
+	for _, tt := range tests {
+		exported := formatted(tt.name, tt.metric)
+		if len(exported) != 1 ||
+			!reflect.DeepEqual(exported[tt.want.Metric], tt.want) {
+			t.Errorf("%s: exported %v, expected %v", tt.name, exported, tt.want)
+		}
+	}
+}
+
+func TestFormatMetricsMeter(t *testing.T) {
+	meter := metrics.NewMeter()
+	defer meter.Stop()
+	meter.Mark(5)
+
+	exported := formatted(`/requests`, meter)
+	want := map[string]bool{
+		`/requests/count`:          true,
+		`/requests/avg/rate/1min`:  true,
+		`/requests/avg/rate/5min`:  true,
+		`/requests/avg/rate/15min`: true,
+		`/requests/avg/rate/mean`:  true,
+	}
+	if names := metricNames(exported); !reflect.DeepEqual(names, want) {
+		t.Fatalf("exported %v, expected %v", names, want)
+	}
+	if m := exported[`/requests/count`]; m.Type != `integer` ||
+		m.Value.IntVal != 5 {
+		t.Errorf("count exported as %v", m)
+	}
+	if m := exported[`/requests/avg/rate/mean`]; m.Type != `float` ||
+		m.Value.FlpVal <= 0 {
+		t.Errorf("mean rate exported as %v", m)
+	}
+}
+
+func TestFormatMetricsDistributions(t *testing.T) {
+	histogram := metrics.NewHistogram(metrics.NewUniformSample(100))
+	timer := metrics.NewTimer()
+	defer timer.Stop()
+	for i := int64(1); i <= 100; i++ {
+		histogram.Update(i)
+		timer.Update(time.Duration(i) * time.Millisecond)
+	}
+
+	distribution := func(name string) map[string]bool {
+		return map[string]bool{
+			name + `/count`:           true,
+			name + `/min`:             true,
+			name + `/max`:             true,
+			name + `/percentile/50`:   true,
+			name + `/percentile/90`:   true,
+			name + `/percentile/99`:   true,
+			name + `/percentile/99.9`: true,
+		}
+	}
+
+	exported := formatted(`/batch/size`, histogram)
+	if names := metricNames(exported); !reflect.DeepEqual(names,
+		distribution(`/batch/size`)) {
+		t.Errorf("histogram exported %v", names)
+	}
+	if exported[`/batch/size/count`].Value.IntVal != 100 ||
+		exported[`/batch/size/min`].Value.IntVal != 1 ||
+		exported[`/batch/size/max`].Value.IntVal != 100 ||
+		exported[`/batch/size/percentile/50`].Value.FlpVal != 50.5 {
+		t.Errorf("histogram exported %v", exported)
+	}
+
+	exported = formatted(`/produce/latency`, timer)
+	want := distribution(`/produce/latency`)
+	for _, rate := range []string{`1min`, `5min`, `15min`, `mean`} {
+		want[`/produce/latency/avg/rate/`+rate] = true
+	}
+	if names := metricNames(exported); !reflect.DeepEqual(names, want) {
+		t.Errorf("timer exported %v", names)
+	}
+	if m := exported[`/produce/latency/max`]; m.Type != `integer` ||
+		m.Value.IntVal != int64(100*time.Millisecond) {
+		t.Errorf("timer maximum exported as %v", m)
+	}
+}
+
+func TestFormatMetricsUnknown(t *testing.T) {
+	if exported := formatted(`/unknown`, struct{}{}); len(exported) != 0 {
+		t.Errorf("unknown metric type exported %v", exported)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
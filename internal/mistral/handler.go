@@ -9,13 +9,18 @@
 package mistral // import "github.com/solnx/mistral/internal/mistral"
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/mjolnir42/delay"
 	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
 	kazoo "github.com/wvanbergen/kazoo-go"
 )
 
@@ -29,41 +34,131 @@ func (m *Mistral) Start() {
 		return
 	}
 
-	kz, err := kazoo.NewKazooFromConnectionString(
-		m.Config.Zookeeper.Connect, nil)
+	// invalid settings are reported before contacting the cluster
+	config, err := ProducerConfig(m.Config)
 	if err != nil {
 		m.Death <- err
 		<-m.Shutdown
 		return
 	}
-	brokers, err := kz.BrokerList()
+
+	// every handler owns a transactional ID that is stable across
+	// restarts, which fences off earlier instances of the handler.
+	// The instance name keeps instances on the same host apart.
+	if m.Config.Kafka.ProducerTransactional {
+		switch m.Config.Misc.InstanceName {
+		case ``:
+			config.Producer.Transaction.ID = fmt.Sprintf("%s.%d",
+				config.ClientID, m.Num)
+		default:
+			config.Producer.Transaction.ID = fmt.Sprintf("%s.%s.%d",
+				config.ClientID, m.Config.Misc.InstanceName, m.Num)
+		}
+	}
+
+	brokers, err := Brokers(m.Config)
 	if err != nil {
-		kz.Close()
 		m.Death <- err
 		<-m.Shutdown
 		return
 	}
-	kz.Close()
 
-	host, err := os.Hostname()
+	// export the fill level of the input queue
+	(*m.Metrics).GetOrRegister(
+		fmt.Sprintf("/handler/%d/queue/depth", m.Num),
+		metrics.NewFunctionalGauge(func() int64 {
+			return int64(len(m.Input))
+		}),
+	)
+
+	m.trackID = make(map[string]*erebos.Transport)
+	m.trackTime = make(map[string]time.Time)
+
+	m.producer, err = sarama.NewAsyncProducer(brokers, config)
 	if err != nil {
-		m.Death <- err
+		m.Death <- fmt.Errorf("Connecting to Kafka via %s failed: %s",
+			brokerSource(m.Config, brokers), err)
 		<-m.Shutdown
 		return
 	}
+	m.dispatch = m.producer.Input()
+	m.delay = delay.New()
+
+	m.run()
+}
+
+// Brokers returns the Kafka brokers to bootstrap from. A static
+// broker list in the configuration takes precedence over the brokers
+// registered in ZooKeeper.
+func Brokers(conf *Config) ([]string, error) {
+	if len(conf.Kafka.Brokers) > 0 {
+		for _, broker := range conf.Kafka.Brokers {
+			if _, _, err := net.SplitHostPort(broker); err != nil {
+				return nil, fmt.Errorf(
+					"Broker discovery via static broker list failed: %s",
+					err)
+			}
+		}
+		return conf.Kafka.Brokers, nil
+	}
+
+	if conf.Zookeeper.Connect == `` {
+		return nil, fmt.Errorf(
+			`Broker discovery failed: neither kafka.brokers nor zookeeper.connect.string configured`)
+	}
+	kz, err := kazoo.NewKazooFromConnectionString(
+		conf.Zookeeper.Connect, nil)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"Broker discovery via ZooKeeper %s failed: %s",
+			conf.Zookeeper.Connect, err)
+	}
+	defer kz.Close()
+
+	brokers, err := kz.BrokerList()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"Broker discovery via ZooKeeper %s failed: %s",
+			conf.Zookeeper.Connect, err)
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf(
+			"Broker discovery via ZooKeeper %s failed: no brokers registered",
+			conf.Zookeeper.Connect)
+	}
+	return brokers, nil
+}
+
+// brokerSource describes how the brokers were discovered, for error
+// messages
+func brokerSource(conf *Config, brokers []string) string {
+	if len(conf.Kafka.Brokers) > 0 {
+		return fmt.Sprintf("static broker list %v", brokers)
+	}
+	return fmt.Sprintf("ZooKeeper %s (brokers %v)",
+		conf.Zookeeper.Connect, brokers)
+}
+
+// ProducerConfig returns the sarama configuration for producing to
+// Kafka
+func ProducerConfig(conf *Config) (*sarama.Config, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
 
 	config := sarama.NewConfig()
 	// set producer transport keepalive
-	switch m.Config.Kafka.Keepalive {
+	switch conf.Kafka.Keepalive {
 	case 0:
 		config.Net.KeepAlive = 3 * time.Second
 	default:
 		config.Net.KeepAlive = time.Duration(
-			m.Config.Kafka.Keepalive,
+			conf.Kafka.Keepalive,
 		) * time.Millisecond
 	}
 	// set our required persistence confidence for producing
-	switch m.Config.Kafka.ProducerResponseStrategy {
+	switch conf.Kafka.ProducerResponseStrategy {
 	case `NoResponse`:
 		config.Producer.RequiredAcks = sarama.NoResponse
 	case `WaitForLocal`:
@@ -79,27 +174,146 @@ func (m *Mistral) Start() {
 	config.Producer.Return.Errors = true
 
 	// set how often to retry producing
-	switch m.Config.Kafka.ProducerRetry {
+	switch conf.Kafka.ProducerRetry {
 	case 0:
 		config.Producer.Retry.Max = 3
 	default:
-		config.Producer.Retry.Max = m.Config.Kafka.ProducerRetry
+		config.Producer.Retry.Max = conf.Kafka.ProducerRetry
+	}
+	// set backoff between retries
+	if conf.Kafka.ProducerRetryBackoff > 0 {
+		config.Producer.Retry.Backoff = time.Duration(
+			conf.Kafka.ProducerRetryBackoff,
+		) * time.Millisecond
 	}
 	config.Producer.Partitioner = sarama.NewHashPartitioner
 	config.ClientID = fmt.Sprintf("mistral.%s", host)
 
-	m.trackID = make(map[string]*erebos.Transport)
+	// set the protocol version spoken with the brokers, required for
+	// zstd compression
+	if conf.Kafka.Version != `` {
+		if config.Version, err = sarama.ParseKafkaVersion(
+			conf.Kafka.Version); err != nil {
+			return nil, err
+		}
+	}
 
-	m.producer, err = sarama.NewAsyncProducer(brokers, config)
-	if err != nil {
-		m.Death <- err
-		<-m.Shutdown
-		return
+	// deduplicate retries on the brokers, the transactional producer
+	// is built on top of the idempotent producer
+	if conf.Kafka.ProducerIdempotent || conf.Kafka.ProducerTransactional {
+		switch conf.Kafka.ProducerResponseStrategy {
+		case ``, `WaitForAll`:
+		default:
+			return nil, fmt.Errorf(
+				"Idempotent producer requires response strategy WaitForAll, not %s",
+				conf.Kafka.ProducerResponseStrategy)
+		}
+		config.Producer.Idempotent = true
+		config.Producer.RequiredAcks = sarama.WaitForAll
+		config.Net.MaxOpenRequests = 1
+		if conf.Kafka.Version == `` {
+			config.Version = sarama.V0_11_0_0
+		}
 	}
-	m.dispatch = m.producer.Input()
-	m.delay = delay.New()
 
-	m.run()
+	// set message compression
+	switch conf.Kafka.ProducerCompression {
+	case ``, `none`:
+		config.Producer.Compression = sarama.CompressionNone
+	case `gzip`:
+		config.Producer.Compression = sarama.CompressionGZIP
+	case `snappy`:
+		config.Producer.Compression = sarama.CompressionSnappy
+	case `lz4`:
+		config.Producer.Compression = sarama.CompressionLZ4
+	case `zstd`:
+		config.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, fmt.Errorf("Unknown producer compression codec: %s",
+			conf.Kafka.ProducerCompression)
+	}
+	if conf.Kafka.ProducerCompressionLevel != 0 {
+		config.Producer.CompressionLevel = conf.Kafka.ProducerCompressionLevel
+	}
+
+	// set batching of messages
+	config.Producer.Flush.Bytes = conf.Kafka.ProducerFlushBytes
+	config.Producer.Flush.Messages = conf.Kafka.ProducerFlushMessages
+	config.Producer.Flush.Frequency = time.Duration(
+		conf.Kafka.ProducerFlushFrequency,
+	) * time.Millisecond
+	if conf.Kafka.ProducerMaxMessageBytes > 0 {
+		config.Producer.MaxMessageBytes = conf.Kafka.ProducerMaxMessageBytes
+	}
+
+	// authenticate against the brokers
+	switch conf.Kafka.SASLMechanism {
+	case ``:
+	case `PLAIN`:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case `SCRAM-SHA-256`:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMSHA256Client
+	case `SCRAM-SHA-512`:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMSHA512Client
+	default:
+		return nil, fmt.Errorf("Unknown SASL mechanism: %s",
+			conf.Kafka.SASLMechanism)
+	}
+	if conf.Kafka.SASLMechanism != `` {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Handshake = true
+		config.Net.SASL.User = conf.Kafka.SASLUsername
+		config.Net.SASL.Password = conf.Kafka.SASLPassword
+	}
+
+	// encrypt the broker connections
+	if conf.Kafka.TLS {
+		if config.Net.TLS.Config, err = brokerTLSConfig(conf); err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+	}
+
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// brokerTLSConfig returns the TLS configuration for the broker
+// connections
+func brokerTLSConfig(conf *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: conf.Kafka.TLSServerName,
+	}
+
+	// verify brokers against the configured CAs instead of the
+	// system pool
+	if conf.Kafka.TLSCAFile != `` {
+		pem, err := ioutil.ReadFile(conf.Kafka.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s",
+				conf.Kafka.TLSCAFile)
+		}
+	}
+
+	// present a client certificate
+	if conf.Kafka.TLSCertFile != `` || conf.Kafka.TLSKeyFile != `` {
+		cert, err := tls.LoadX509KeyPair(conf.Kafka.TLSCertFile,
+			conf.Kafka.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
 }
 
 // InputChannel returns the data input channel
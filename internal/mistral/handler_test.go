@@ -0,0 +1,237 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestProducerConfigCompression(t *testing.T) {
+	tests := []struct {
+		codec   string
+		version string
+		want    sarama.CompressionCodec
+		err     string
+	}{
+		{``, ``, sarama.CompressionNone, ``},
+		{`none`, ``, sarama.CompressionNone, ``},
+		{`gzip`, ``, sarama.CompressionGZIP, ``},
+		{`snappy`, ``, sarama.CompressionSnappy, ``},
+		{`lz4`, `0.10.0.0`, sarama.CompressionLZ4, ``},
+		{`zstd`, `2.1.0`, sarama.CompressionZSTD, ``},
+		{`zstd`, `1.0.0`, 0, `zstd compression requires Version >= V2_1_0_0`},
+		{`brotli`, ``, 0, `Unknown producer compression codec: brotli`},
+	}
+	for _, tt := range tests {
+		conf := &Config{}
+		conf.Kafka.ProducerCompression = tt.codec
+		conf.Kafka.Version = tt.version
+
+		config, err := ProducerConfig(conf)
+		if !errorMatches(t, `codec `+tt.codec, err, tt.err) {
+			continue
+		}
+		if config.Producer.Compression != tt.want {
+			t.Errorf("codec %s: compression %v, expected %v", tt.codec,
+				config.Producer.Compression, tt.want)
+		}
+	}
+}
+
+func TestProducerConfigVersion(t *testing.T) {
+	conf := &Config{}
+	conf.Kafka.Version = `2.8.1`
+	config, err := ProducerConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Version != sarama.V2_8_1_0 {
+		t.Errorf("version %s, expected %s", config.Version, sarama.V2_8_1_0)
+	}
+
+	conf.Kafka.Version = `latest`
+	if _, err := ProducerConfig(conf); err == nil {
+		t.Error(`invalid version was accepted`)
+	}
+}
+
+func TestProducerConfigIdempotent(t *testing.T) {
+	tests := []struct {
+		name          string
+		idempotent    bool
+		transactional bool
+		strategy      string
+		version       string
+		want          sarama.KafkaVersion
+		err           string
+	}{
+		{`default strategy`, true, false, ``, ``, sarama.V0_11_0_0, ``},
+		{`WaitForAll`, true, false, `WaitForAll`, ``, sarama.V0_11_0_0, ``},
+		{`configured version`, true, false, ``, `2.1.0`, sarama.V2_1_0_0, ``},
+		{`transactional`, false, true, ``, ``, sarama.V0_11_0_0, ``},
+		{`WaitForLocal`, true, false, `WaitForLocal`, ``, sarama.KafkaVersion{},
+			`requires response strategy WaitForAll, not WaitForLocal`},
+		{`transactional NoResponse`, false, true, `NoResponse`, ``,
+			sarama.KafkaVersion{},
+			`requires response strategy WaitForAll, not NoResponse`},
+		{`version too old`, true, false, ``, `0.10.2.0`, sarama.KafkaVersion{},
+			`Idempotent producer requires Version >= V0_11_0_0`},
+	}
+	for _, tt := range tests {
+		conf := &Config{}
+		conf.Kafka.ProducerIdempotent = tt.idempotent
+		conf.Kafka.ProducerTransactional = tt.transactional
+		conf.Kafka.ProducerResponseStrategy = tt.strategy
+		conf.Kafka.Version = tt.version
+
+		config, err := ProducerConfig(conf)
+		if !errorMatches(t, tt.name, err, tt.err) {
+			continue
+		}
+		if !config.Producer.Idempotent ||
+			config.Producer.RequiredAcks != sarama.WaitForAll ||
+			config.Net.MaxOpenRequests != 1 {
+			t.Errorf("%s: idempotent %t, acks %d, max open requests %d",
+				tt.name, config.Producer.Idempotent,
+				config.Producer.RequiredAcks, config.Net.MaxOpenRequests)
+		}
+		if config.Version != tt.want {
+			t.Errorf("%s: version %s, expected %s", tt.name, config.Version,
+				tt.want)
+		}
+	}
+}
+
+func TestProducerConfigSASL(t *testing.T) {
+	tests := []struct {
+		mechanism string
+		user      string
+		want      sarama.SASLMechanism
+		scram     bool
+		err       string
+	}{
+		{`PLAIN`, `mistral`, sarama.SASLTypePlaintext, false, ``},
+		{`SCRAM-SHA-256`, `mistral`, sarama.SASLTypeSCRAMSHA256, true, ``},
+		{`SCRAM-SHA-512`, `mistral`, sarama.SASLTypeSCRAMSHA512, true, ``},
+		{`GSSAPI`, `mistral`, ``, false, `Unknown SASL mechanism: GSSAPI`},
+		{`PLAIN`, ``, ``, false, `Net.SASL.User must not be empty`},
+	}
+	for _, tt := range tests {
+		conf := &Config{}
+		conf.Kafka.SASLMechanism = tt.mechanism
+		conf.Kafka.SASLUsername = tt.user
+		conf.Kafka.SASLPassword = `secret`
+
+		config, err := ProducerConfig(conf)
+		if !errorMatches(t, tt.mechanism, err, tt.err) {
+			continue
+		}
+		if !config.Net.SASL.Enable || config.Net.SASL.Mechanism != tt.want ||
+			config.Net.SASL.User != `mistral` {
+			t.Errorf("%s: enabled %t, mechanism %s, user %q", tt.mechanism,
+				config.Net.SASL.Enable, config.Net.SASL.Mechanism,
+				config.Net.SASL.User)
+		}
+		if (config.Net.SASL.SCRAMClientGeneratorFunc != nil) != tt.scram {
+			t.Errorf("%s: SCRAM client set %t, expected %t", tt.mechanism,
+				!tt.scram, tt.scram)
+		}
+	}
+
+	// SASL stays disabled unless configured
+	config, err := ProducerConfig(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Net.SASL.Enable {
+		t.Error(`SASL is enabled without a mechanism`)
+	}
+}
+
+func TestProducerConfigTLS(t *testing.T) {
+	conf := &Config{}
+	conf.Kafka.TLS = true
+	conf.Kafka.TLSServerName = `kafka.example.com`
+	config, err := ProducerConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Net.TLS.Enable ||
+		config.Net.TLS.Config.ServerName != `kafka.example.com` ||
+		config.Net.TLS.Config.RootCAs != nil {
+		t.Error(`TLS is not configured with the system CAs and server name`)
+	}
+
+	missing := filepath.Join(t.TempDir(), `missing.pem`)
+	tests := []struct {
+		name string
+		set  func(*Config)
+	}{
+		{`missing CA file`, func(c *Config) { c.Kafka.TLSCAFile = missing }},
+		{`CA file without certificates`, func(c *Config) {
+			c.Kafka.TLSCAFile = `handler_test.go`
+		}},
+		{`certificate without key`, func(c *Config) {
+			c.Kafka.TLSCertFile = missing
+		}},
+	}
+	for _, tt := range tests {
+		conf := &Config{}
+		conf.Kafka.TLS = true
+		tt.set(conf)
+		if _, err := ProducerConfig(conf); err == nil {
+			t.Errorf("%s: TLS configuration was accepted", tt.name)
+		}
+	}
+
+	// TLS settings are ignored while TLS is disabled
+	conf = &Config{}
+	conf.Kafka.TLSCAFile = missing
+	if _, err := ProducerConfig(conf); err != nil {
+		t.Errorf("TLS settings were checked with TLS disabled: %s", err)
+	}
+}
+
+func TestBrokerSource(t *testing.T) {
+	conf := &Config{}
+	conf.Kafka.Brokers = []string{`kafka1:9092`}
+	if got := brokerSource(conf, conf.Kafka.Brokers); got !=
+		`static broker list [kafka1:9092]` {
+		t.Errorf("static brokers: %q", got)
+	}
+
+	conf = &Config{}
+	conf.Zookeeper.Connect = `zk1:2181/kafka`
+	if got := brokerSource(conf, []string{`kafka1:9092`}); !strings.HasPrefix(
+		got, `ZooKeeper zk1:2181/kafka`) {
+		t.Errorf("ZooKeeper brokers: %q", got)
+	}
+}
+
+// errorMatches reports whether the test case name can continue with
+// checks of the result, after it compared err against the expected
+// error message
+func errorMatches(t *testing.T, name string, err error, msg string) bool {
+	t.Helper()
+	switch {
+	case msg == `` && err != nil:
+		t.Errorf("%s: unexpected error: %s", name, err)
+	case msg != `` && err == nil:
+		t.Errorf("%s: expected error %q", name, msg)
+	case msg != `` && !strings.Contains(err.Error(), msg):
+		t.Errorf("%s: error %q, expected %q", name, err, msg)
+	}
+	return msg == `` && err == nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
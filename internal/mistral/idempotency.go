@@ -0,0 +1,160 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Idempotency suppresses duplicate batches. It is disabled if nil.
+var Idempotency *IdempotencyCache
+
+// IdempotencyCache remembers the result of recently delivered
+// batches. Repeated batches are answered with the original result
+// instead of being produced again.
+type IdempotencyCache struct {
+	mux     sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// idempotencyEntry is the result of a delivered batch. While the
+// batch is delivered, done is open and status is 0.
+type idempotencyEntry struct {
+	key     string
+	done    chan struct{}
+	status  int
+	rcpt    *Receipt
+	expires time.Time
+}
+
+// NewIdempotencyCache returns a cache that holds the results of up
+// to size batches for ttl
+func NewIdempotencyCache(size int, ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// idempotencyKey returns the cache key for a batch of hostID. Clients
+// can set the Idempotency-Key header, otherwise the batch content is
+// hashed.
+func idempotencyKey(r *http.Request, hostID int, data []byte) string {
+	if key := r.Header.Get(`Idempotency-Key`); key != `` {
+		// keys are only unique per client and host
+		return `key:` + Principal(r) + "\x00" +
+			strconv.Itoa(hostID) + "\x00" + key
+	}
+	sum := sha256.New()
+	sum.Write([]byte(strconv.Itoa(hostID)))
+	sum.Write([]byte{0})
+	sum.Write(data)
+	return `sha256:` + hex.EncodeToString(sum.Sum(nil))
+}
+
+// deliverOnce delivers data like deliver, unless the same batch was
+// delivered within the TTL of the Idempotency cache
+func deliverOnce(r *http.Request, hostID int, data []byte) (int, *Receipt) {
+	if Idempotency == nil {
+		return deliverSigned(r, hostID, data)
+	}
+	return Idempotency.do(r, idempotencyKey(r, hostID, data),
+		func() (int, *Receipt) {
+			return deliverSigned(r, hostID, data)
+		})
+}
+
+// do returns the cached result for key or calls fn and caches its
+// result if it succeeded. Concurrent calls for the same key wait for
+// the first one.
+func (c *IdempotencyCache) do(r *http.Request, key string,
+	fn func() (int, *Receipt)) (int, *Receipt) {
+
+	for {
+		c.mux.Lock()
+		if el, ok := c.entries[key]; ok {
+			e := el.Value.(*idempotencyEntry)
+			if e.status == 0 || time.Now().Before(e.expires) {
+				c.mux.Unlock()
+				select {
+				case <-e.done:
+				case <-r.Context().Done():
+					return http.StatusRequestTimeout, nil
+				}
+				if e.status != 0 {
+					logrus.Infof(
+						"Suppressed duplicate batch for key %s from %s",
+						key, r.RemoteAddr)
+					c.mark(`/idempotency/hit`)
+					return e.status, e.rcpt
+				}
+				// the first delivery failed, try again
+				continue
+			}
+			c.remove(el)
+		}
+
+		e := &idempotencyEntry{
+			key:  key,
+			done: make(chan struct{}),
+		}
+		c.entries[key] = c.order.PushFront(e)
+		for c.order.Len() > c.size {
+			c.remove(c.order.Back())
+		}
+		c.mux.Unlock()
+		c.mark(`/idempotency/miss`)
+
+		status, rcpt := fn()
+
+		c.mux.Lock()
+		switch status {
+		case http.StatusOK, http.StatusAccepted:
+			e.status = status
+			e.rcpt = rcpt
+			e.expires = time.Now().Add(c.ttl)
+		default:
+			if el, ok := c.entries[key]; ok && el.Value == e {
+				c.remove(el)
+			}
+		}
+		c.mux.Unlock()
+		close(e.done)
+		return status, rcpt
+	}
+}
+
+// remove drops the cache entry el. The caller must hold c.mux.
+func (c *IdempotencyCache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*idempotencyEntry).key)
+	c.order.Remove(el)
+}
+
+// mark counts cache hits and misses
+func (c *IdempotencyCache) mark(name string) {
+	if MtrReg != nil {
+		metrics.GetOrRegisterMeter(name, *MtrReg).Mark(1)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,193 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingDelivery returns a delivery function that answers with
+// status and counts its calls in calls
+func countingDelivery(calls *int32, status int) func() (int, *Receipt) {
+	return func() (int, *Receipt) {
+		n := atomic.AddInt32(calls, 1)
+		return status, &Receipt{Offset: int64(n)}
+	}
+}
+
+func TestIdempotencyHitWithinTTL(t *testing.T) {
+	c := NewIdempotencyCache(10, time.Minute)
+	r := httptest.NewRequest(`POST`, `/`, nil)
+	var calls int32
+
+	status, rcpt := c.do(r, `key`, countingDelivery(&calls, http.StatusOK))
+	if status != http.StatusOK || rcpt.Offset != 1 {
+		t.Fatalf("first delivery: %d, %+v", status, rcpt)
+	}
+	status, rcpt = c.do(r, `key`, countingDelivery(&calls, http.StatusOK))
+	if status != http.StatusOK || rcpt.Offset != 1 {
+		t.Fatalf("duplicate: %d, %+v, expected the first result", status, rcpt)
+	}
+	if calls != 1 {
+		t.Fatalf("delivered %d times, expected once", calls)
+	}
+
+	// other keys are delivered
+	c.do(r, `other`, countingDelivery(&calls, http.StatusOK))
+	if calls != 2 {
+		t.Fatalf("delivered %d times, expected twice", calls)
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	c := NewIdempotencyCache(10, 10*time.Millisecond)
+	r := httptest.NewRequest(`POST`, `/`, nil)
+	var calls int32
+
+	c.do(r, `key`, countingDelivery(&calls, http.StatusOK))
+	time.Sleep(20 * time.Millisecond)
+	_, rcpt := c.do(r, `key`, countingDelivery(&calls, http.StatusOK))
+	if calls != 2 || rcpt.Offset != 2 {
+		t.Fatalf("delivered %d times with receipt %+v, expected a new delivery",
+			calls, rcpt)
+	}
+}
+
+func TestIdempotencyConcurrentDuplicateWaits(t *testing.T) {
+	c := NewIdempotencyCache(10, time.Minute)
+	r := httptest.NewRequest(`POST`, `/`, nil)
+	var calls int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	first := make(chan int, 1)
+	go func() {
+		status, _ := c.do(r, `key`, func() (int, *Receipt) {
+			atomic.AddInt32(&calls, 1)
+			close(started)
+			<-release
+			return http.StatusOK, &Receipt{Offset: 1}
+		})
+		first <- status
+	}()
+	<-started
+
+	// duplicates wait for the pending first delivery
+	wg := sync.WaitGroup{}
+	results := make(chan *Receipt, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, rcpt := c.do(r, `key`, countingDelivery(&calls, http.StatusOK))
+			results <- rcpt
+		}()
+	}
+	select {
+	case rcpt := <-results:
+		t.Fatalf("duplicate returned %+v before the first delivery finished", rcpt)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	wg.Wait()
+	close(results)
+	if status := <-first; status != http.StatusOK {
+		t.Fatalf("first delivery: %d", status)
+	}
+	for rcpt := range results {
+		if rcpt == nil || rcpt.Offset != 1 {
+			t.Errorf("duplicate got %+v, expected the first result", rcpt)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("delivered %d times, expected once", calls)
+	}
+}
+
+func TestIdempotencyRetryAfterFailure(t *testing.T) {
+	c := NewIdempotencyCache(10, time.Minute)
+	r := httptest.NewRequest(`POST`, `/`, nil)
+	var calls int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	go c.do(r, `key`, func() (int, *Receipt) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return http.StatusBadGateway, nil
+	})
+	<-started
+
+	// the waiting duplicate delivers itself once the first delivery
+	// failed
+	retried := make(chan int, 1)
+	go func() {
+		status, _ := c.do(r, `key`, countingDelivery(&calls, http.StatusOK))
+		retried <- status
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	if status := <-retried; status != http.StatusOK {
+		t.Fatalf("retry: %d, expected %d", status, http.StatusOK)
+	}
+	if calls != 2 {
+		t.Fatalf("delivered %d times, expected twice", calls)
+	}
+
+	// the successful retry is cached
+	c.do(r, `key`, countingDelivery(&calls, http.StatusOK))
+	if calls != 2 {
+		t.Fatalf("delivered %d times, expected twice", calls)
+	}
+}
+
+func TestIdempotencyEvictsPendingEntry(t *testing.T) {
+	c := NewIdempotencyCache(1, time.Minute)
+	r := httptest.NewRequest(`POST`, `/`, nil)
+	var calls int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	go c.do(r, `key`, func() (int, *Receipt) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return http.StatusOK, &Receipt{Offset: 1}
+	})
+	<-started
+
+	waiting := make(chan *Receipt, 1)
+	go func() {
+		_, rcpt := c.do(r, `key`, countingDelivery(&calls, http.StatusOK))
+		waiting <- rcpt
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// another key evicts the pending entry from the full cache
+	c.do(r, `other`, countingDelivery(&calls, http.StatusOK))
+	close(release)
+
+	// the waiter still receives the result of the first delivery
+	if rcpt := <-waiting; rcpt == nil || rcpt.Offset != 1 {
+		t.Fatalf("waiter got %+v, expected the first result", rcpt)
+	}
+	if calls != 2 {
+		t.Fatalf("delivered %d times, expected twice", calls)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
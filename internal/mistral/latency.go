@@ -0,0 +1,104 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// requestTiming records the phases of a request
+type requestTiming struct {
+	start  time.Time
+	decode time.Duration
+}
+
+// statusWriter records the status code written to a
+// http.ResponseWriter
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records status and writes it to the wrapped
+// http.ResponseWriter
+func (s *statusWriter) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Timed records the total duration of requests to h and the time
+// spent reading and decoding their bodies, broken down by response
+// status.
+func Timed(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		rt := &requestTiming{start: time.Now()}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		ctx := context.WithValue(r.Context(), timingKey, rt)
+		h(sw, r.WithContext(ctx), ps)
+
+		if MtrReg == nil {
+			return
+		}
+		metrics.GetOrRegisterTimer(
+			fmt.Sprintf("/latency/total/%d", sw.status),
+			*MtrReg,
+		).UpdateSince(rt.start)
+		if rt.decode > 0 {
+			metrics.GetOrRegisterTimer(
+				fmt.Sprintf("/latency/decode/%d", sw.status),
+				*MtrReg,
+			).Update(rt.decode)
+		}
+	}
+}
+
+// decoded marks the end of reading and decoding the body of r
+func decoded(r *http.Request) {
+	if rt, ok := r.Context().Value(timingKey).(*requestTiming); ok {
+		rt.decode = time.Since(rt.start)
+	}
+}
+
+// updateQueueWait records how long the batch with the state st
+// waited in the input queue of the handler
+func (m *Mistral) updateQueueWait(st *requestState) {
+	if st == nil {
+		return
+	}
+	metrics.GetOrRegisterTimer(
+		fmt.Sprintf("/latency/queue/handler/%d", m.Num),
+		*m.Metrics,
+	).UpdateSince(st.queuedAt)
+}
+
+// updateProduce records how long producing the message with the
+// trackingID took, broken down by result
+func (m *Mistral) updateProduce(trackingID string, err error) {
+	t, ok := m.trackTime[trackingID]
+	delete(m.trackTime, trackingID)
+	if !ok {
+		return
+	}
+	result := `success`
+	if err != nil {
+		result = `error`
+	}
+	metrics.GetOrRegisterTimer(
+		fmt.Sprintf("/latency/produce/handler/%d/%s", m.Num, result),
+		*m.Metrics,
+	).UpdateSince(t)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,138 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// MaxBodySize is the maximum size in bytes of a request body as
+// received. It is not enforced if it is 0.
+var MaxBodySize int64
+
+// connProgress is the progress of a connection through its current
+// request
+type connProgress struct {
+	// bytes of a request were read
+	active bool
+	// the request was passed to the handler
+	served bool
+}
+
+// conns tracks the progress of all open connections
+var conns = struct {
+	sync.Mutex
+	m map[net.Conn]*connProgress
+}{m: make(map[net.Conn]*connProgress)}
+
+// ConnContext implements http.Server.ConnContext. It makes the
+// connection of a request known to Tracked.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey, c)
+}
+
+// ConnState implements http.Server.ConnState. It counts connections
+// that are closed after a request was started but before it was
+// passed to the handler, which happens if the header exceeds the size
+// limit, is malformed or the header read timeout expires. Connections
+// that are closed without sending any data are not counted.
+func ConnState(c net.Conn, state http.ConnState) {
+	conns.Lock()
+	defer conns.Unlock()
+
+	switch state {
+	case http.StateNew:
+		conns.m[c] = &connProgress{}
+	case http.StateActive:
+		if p, ok := conns.m[c]; ok {
+			p.active = true
+		}
+	case http.StateIdle:
+		// the request is complete, wait for the next one
+		if p, ok := conns.m[c]; ok {
+			p.active = false
+			p.served = false
+		}
+	case http.StateHijacked, http.StateClosed:
+		if p, ok := conns.m[c]; ok && p.active && !p.served {
+			markRejected(`/rejected/header`)
+		}
+		delete(conns.m, c)
+	}
+}
+
+// Tracked marks the requests that are passed to h for ConnState and
+// counts responses that took longer than the write timeout of the
+// server, which are cut off
+func Tracked(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if c, ok := r.Context().Value(connKey).(net.Conn); ok {
+			conns.Lock()
+			if p, ok := conns.m[c]; ok {
+				p.served = true
+			}
+			conns.Unlock()
+		}
+
+		h.ServeHTTP(w, r)
+
+		// the write deadline is set once the request header is read
+		srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server)
+		if ok && srv.WriteTimeout > 0 &&
+			time.Since(start) >= srv.WriteTimeout {
+			markRejected(`/rejected/write_timeout`)
+		}
+	})
+}
+
+// readErrorStatus returns the HTTP status code for an error that
+// occurred while reading a request body
+func readErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusRequestTimeout
+	}
+	return http.StatusBadRequest
+}
+
+// markRejectedStatus counts a request rejected with status while
+// reading its body
+func markRejectedStatus(status int) {
+	switch status {
+	case http.StatusRequestEntityTooLarge:
+		markRejected(`/rejected/body_size`)
+	case http.StatusRequestTimeout:
+		markRejected(`/rejected/read_timeout`)
+	case http.StatusUnsupportedMediaType:
+		markRejected(`/rejected/encoding`)
+	}
+}
+
+// markRejected marks the rejection meter name
+func markRejected(name string) {
+	if MtrReg == nil {
+		return
+	}
+	metrics.GetOrRegisterMeter(name, *MtrReg).Mark(1)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
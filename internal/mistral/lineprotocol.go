@@ -0,0 +1,344 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/julienschmidt/httprouter"
+	"github.com/solnx/legacy"
+)
+
+// LineProtocolHostTag is the name of the tag that carries the HostID
+// of a point received via LineProtocol
+var LineProtocolHostTag = `host_id`
+
+// linePoint is a single point of an InfluxDB line protocol request
+type linePoint struct {
+	measurement string
+	tags        map[string]string
+	fields      []lineField
+	timestamp   time.Time
+}
+
+// lineField is a single field of a linePoint
+type lineField struct {
+	key   string
+	typ   string
+	value legacy.MetricValue
+}
+
+// LineProtocol is the HTTP API endpoint for InfluxDB line protocol
+// writes. The received points are converted into one
+// legacy.MetricBatch per HostID. Malformed lines are reported with
+// their line number, all other points are still produced.
+func LineProtocol(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+
+	buf, ok := readRequest(w, r)
+	if !ok {
+		return
+	}
+
+	precision, err := linePrecision(r.URL.Query().Get(`precision`))
+	if err != nil {
+		logrus.Warningf("Rejected line protocol request from %s: %s",
+			r.RemoteAddr, err.Error())
+
+		http.Error(w,
+			err.Error(),
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	batches := make(map[int]*legacy.MetricBatch)
+	lineErrors := []string{}
+	now := time.Now().UTC()
+
+	for num, line := range bytes.Split(buf, []byte("\n")) {
+		text := strings.TrimSpace(string(line))
+		if text == `` || strings.HasPrefix(text, `#`) {
+			continue
+		}
+
+		point, err := parseLine(text, now, precision)
+		if err != nil {
+			lineErrors = append(lineErrors,
+				fmt.Sprintf("line %d: %s", num+1, err.Error()))
+			continue
+		}
+
+		hostID, err := strconv.Atoi(point.tags[LineProtocolHostTag])
+		if err != nil || hostID <= 0 {
+			lineErrors = append(lineErrors,
+				fmt.Sprintf("line %d: missing or invalid %s tag",
+					num+1, LineProtocolHostTag))
+			continue
+		}
+
+		if _, ok := batches[hostID]; !ok {
+			batches[hostID] = &legacy.MetricBatch{
+				HostID: hostID,
+				Data:   []legacy.MetricData{},
+			}
+		}
+		batches[hostID].Data = append(batches[hostID].Data,
+			point.metricData())
+	}
+
+	decoded(r)
+
+	if len(lineErrors) > 0 {
+		logrus.Warningf(
+			"Rejected %d malformed lines from %s, first: %s",
+			len(lineErrors), r.RemoteAddr, lineErrors[0])
+	}
+
+	// send data to application handlers for kafka production
+	status := http.StatusOK
+	if len(batches) > 0 {
+		status = deliverBatches(r, batches)
+		if status != http.StatusOK && status != http.StatusAccepted {
+			if status == http.StatusTooManyRequests {
+				setRetryAfter(w)
+			}
+			http.Error(w,
+				http.StatusText(status),
+				status,
+			)
+			return
+		}
+	}
+
+	// report malformed lines after the valid points have been
+	// produced
+	if len(lineErrors) > 0 {
+		http.Error(w,
+			strings.Join(lineErrors, "\n"),
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(nil)
+}
+
+// metricData converts p into the legacy format. Every field becomes
+// a metric named measurement/field.
+func (p *linePoint) metricData() legacy.MetricData {
+	tags := make([]string, 0, len(p.tags))
+	for key, value := range p.tags {
+		if key == LineProtocolHostTag {
+			continue
+		}
+		tags = append(tags, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(tags)
+
+	data := legacy.MetricData{
+		Time:    p.timestamp,
+		Metrics: make([]legacy.Metric, 0, len(p.fields)),
+	}
+	for _, f := range p.fields {
+		data.Metrics = append(data.Metrics, legacy.Metric{
+			Metric: fmt.Sprintf("%s/%s", p.measurement, f.key),
+			Type:   f.typ,
+			Tags:   tags,
+			Value:  f.value,
+		})
+	}
+	return data
+}
+
+// linePrecision returns the timestamp unit for the precision query
+// parameter
+func linePrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case ``, `n`, `ns`:
+		return time.Nanosecond, nil
+	case `u`, `us`, `µ`:
+		return time.Microsecond, nil
+	case `ms`:
+		return time.Millisecond, nil
+	case `s`:
+		return time.Second, nil
+	case `m`:
+		return time.Minute, nil
+	case `h`:
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("Invalid precision: %s", precision)
+}
+
+// parseLine parses a single line of InfluxDB line protocol:
+// measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func parseLine(line string, now time.Time,
+	precision time.Duration) (*linePoint, error) {
+
+	sections := splitLine(line, ' ', true)
+	switch {
+	case len(sections) < 2:
+		return nil, fmt.Errorf(`missing fields`)
+	case len(sections) > 3:
+		return nil, fmt.Errorf(`invalid field format`)
+	}
+
+	point := &linePoint{
+		tags:      make(map[string]string),
+		fields:    []lineField{},
+		timestamp: now,
+	}
+
+	// measurement and tags
+	keys := splitLine(sections[0], ',', false)
+	point.measurement = unescapeLine(keys[0], `, `)
+	if point.measurement == `` {
+		return nil, fmt.Errorf(`missing measurement`)
+	}
+	for _, pair := range keys[1:] {
+		kv := splitLine(pair, '=', false)
+		if len(kv) != 2 || kv[0] == `` || kv[1] == `` {
+			return nil, fmt.Errorf("invalid tag: %s", pair)
+		}
+		point.tags[unescapeLine(kv[0], `,= `)] = unescapeLine(kv[1], `,= `)
+	}
+
+	// fields
+	for _, pair := range splitLine(sections[1], ',', true) {
+		kv := splitLine(pair, '=', true)
+		if len(kv) != 2 || kv[0] == `` || kv[1] == `` {
+			return nil, fmt.Errorf("invalid field: %s", pair)
+		}
+		field, err := parseLineField(unescapeLine(kv[0], `,= `), kv[1])
+		if err != nil {
+			return nil, err
+		}
+		point.fields = append(point.fields, field)
+	}
+
+	// optional timestamp
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp: %s", sections[2])
+		}
+		// the timestamp has to fit into int64 nanoseconds
+		if ts > math.MaxInt64/int64(precision) ||
+			ts < math.MinInt64/int64(precision) {
+			return nil, fmt.Errorf("timestamp out of range: %s", sections[2])
+		}
+		point.timestamp = time.Unix(0, ts*int64(precision)).UTC()
+	}
+	return point, nil
+}
+
+// parseLineField parses the value of a line protocol field
+func parseLineField(key, value string) (lineField, error) {
+	field := lineField{key: key}
+
+	switch {
+	case strings.HasPrefix(value, `"`):
+		if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+			return field, fmt.Errorf("unterminated string in field %s", key)
+		}
+		field.typ = `string`
+		field.value.StrVal = unescapeLine(value[1:len(value)-1], `"\`)
+	case strings.HasSuffix(value, `i`):
+		i, err := strconv.ParseInt(strings.TrimSuffix(value, `i`), 10, 64)
+		if err != nil {
+			return field, fmt.Errorf("invalid integer in field %s: %s",
+				key, value)
+		}
+		field.typ = `integer`
+		field.value.IntVal = i
+	case strings.HasSuffix(value, `u`):
+		u, err := strconv.ParseUint(strings.TrimSuffix(value, `u`), 10, 64)
+		if err != nil || u > math.MaxInt64 {
+			return field, fmt.Errorf("invalid unsigned integer in field %s: %s",
+				key, value)
+		}
+		field.typ = `integer`
+		field.value.IntVal = int64(u)
+	default:
+		switch value {
+		case `t`, `T`, `true`, `True`, `TRUE`:
+			field.typ = `integer`
+			field.value.IntVal = 1
+			return field, nil
+		case `f`, `F`, `false`, `False`, `FALSE`:
+			field.typ = `integer`
+			field.value.IntVal = 0
+			return field, nil
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return field, fmt.Errorf("invalid number in field %s: %s",
+				key, value)
+		}
+		field.typ = `real`
+		field.value.FlpVal = f
+	}
+	return field, nil
+}
+
+// splitLine splits s at every occurrence of sep that is neither
+// escaped by a backslash nor, if quoted is true, inside a double
+// quoted string
+func splitLine(s string, sep byte, quoted bool) []string {
+	parts := []string{}
+	inQuote := false
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			// skip the escaped character
+			i++
+		case s[i] == '"' && quoted:
+			inQuote = !inQuote
+		case s[i] == sep && !inQuote:
+			parts = append(parts, s[start:i])
+			start = i + 1
+			// only the first separator counts between key and value
+			if sep == '=' {
+				return append(parts, s[start:])
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeLine removes the backslash in front of every character in
+// escaped. Backslashes in front of other characters are kept.
+func unescapeLine(s, escaped string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) &&
+			strings.IndexByte(escaped, s[i+1]) >= 0 {
+			i++
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,235 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/solnx/legacy"
+)
+
+func TestParseLine(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		line        string
+		precision   time.Duration
+		measurement string
+		tags        map[string]string
+		fields      []lineField
+		timestamp   time.Time
+	}{
+		{
+			name:        `float field without timestamp`,
+			line:        `cpu,host_id=1 usage=0.5`,
+			precision:   time.Nanosecond,
+			measurement: `cpu`,
+			tags:        map[string]string{`host_id`: `1`},
+			fields: []lineField{
+				{key: `usage`, typ: `real`, value: legacy.MetricValue{FlpVal: 0.5}},
+			},
+			timestamp: now,
+		},
+		{
+			name:        `type suffixes and booleans`,
+			line:        `disk,host_id=2 used=42i,free=7u,ok=t,full=FALSE 1496318400000000000`,
+			precision:   time.Nanosecond,
+			measurement: `disk`,
+			tags:        map[string]string{`host_id`: `2`},
+			fields: []lineField{
+				{key: `used`, typ: `integer`, value: legacy.MetricValue{IntVal: 42}},
+				{key: `free`, typ: `integer`, value: legacy.MetricValue{IntVal: 7}},
+				{key: `ok`, typ: `integer`, value: legacy.MetricValue{IntVal: 1}},
+				{key: `full`, typ: `integer`, value: legacy.MetricValue{IntVal: 0}},
+			},
+			timestamp: now,
+		},
+		{
+			name:        `quoted string field with separators`,
+			line:        `log,host_id=3 msg="a b,c=d \"e\" \\f",n=1i`,
+			precision:   time.Nanosecond,
+			measurement: `log`,
+			tags:        map[string]string{`host_id`: `3`},
+			fields: []lineField{
+				{key: `msg`, typ: `string`, value: legacy.MetricValue{StrVal: `a b,c=d "e" \f`}},
+				{key: `n`, typ: `integer`, value: legacy.MetricValue{IntVal: 1}},
+			},
+			timestamp: now,
+		},
+		{
+			name:        `escaped measurement, tags and field key`,
+			line:        `my\ cpu,host_id=4,dc=us\,east,rack\=x=a\ b load\ avg=1`,
+			precision:   time.Nanosecond,
+			measurement: `my cpu`,
+			tags: map[string]string{
+				`host_id`: `4`,
+				`dc`:      `us,east`,
+				`rack=x`:  `a b`,
+			},
+			fields: []lineField{
+				{key: `load avg`, typ: `real`, value: legacy.MetricValue{FlpVal: 1}},
+			},
+			timestamp: now,
+		},
+		{
+			name:        `second precision`,
+			line:        `cpu,host_id=1 usage=1 1496318400`,
+			precision:   time.Second,
+			measurement: `cpu`,
+			tags:        map[string]string{`host_id`: `1`},
+			fields: []lineField{
+				{key: `usage`, typ: `real`, value: legacy.MetricValue{FlpVal: 1}},
+			},
+			timestamp: now,
+		},
+		{
+			name:        `hour precision`,
+			line:        `cpu,host_id=1 usage=1 415644`,
+			precision:   time.Hour,
+			measurement: `cpu`,
+			tags:        map[string]string{`host_id`: `1`},
+			fields: []lineField{
+				{key: `usage`, typ: `real`, value: legacy.MetricValue{FlpVal: 1}},
+			},
+			timestamp: now,
+		},
+	}
+
+	for _, tt := range tests {
+		point, err := parseLine(tt.line, now, tt.precision)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+			continue
+		}
+		if point.measurement != tt.measurement {
+			t.Errorf("%s: measurement %q, expected %q", tt.name,
+				point.measurement, tt.measurement)
+		}
+		if !reflect.DeepEqual(point.tags, tt.tags) {
+			t.Errorf("%s: tags %v, expected %v", tt.name, point.tags, tt.tags)
+		}
+		if !reflect.DeepEqual(point.fields, tt.fields) {
+			t.Errorf("%s: fields %+v, expected %+v", tt.name,
+				point.fields, tt.fields)
+		}
+		if !point.timestamp.Equal(tt.timestamp) {
+			t.Errorf("%s: timestamp %s, expected %s", tt.name,
+				point.timestamp, tt.timestamp)
+		}
+	}
+}
+
+func TestParseLineMalformed(t *testing.T) {
+	tests := []struct {
+		line      string
+		precision time.Duration
+		err       string
+	}{
+		{`cpu`, time.Nanosecond, `missing fields`},
+		{`cpu,host_id=1 usage=1 1 extra`, time.Nanosecond, `invalid field format`},
+		{`,host_id=1 usage=1`, time.Nanosecond, `missing measurement`},
+		{`cpu,host_id usage=1`, time.Nanosecond, `invalid tag`},
+		{`cpu,host_id= usage=1`, time.Nanosecond, `invalid tag`},
+		{`cpu,host_id=1 usage`, time.Nanosecond, `invalid field`},
+		{`cpu,host_id=1 =1`, time.Nanosecond, `invalid field`},
+		{`cpu,host_id=1 msg="open`, time.Nanosecond, `unterminated string`},
+		{`cpu,host_id=1 used=1.5i`, time.Nanosecond, `invalid integer`},
+		{`cpu,host_id=1 used=-1u`, time.Nanosecond, `invalid unsigned integer`},
+		{`cpu,host_id=1 used=18446744073709551615u`, time.Nanosecond, `invalid unsigned integer`},
+		{`cpu,host_id=1 usage=abc`, time.Nanosecond, `invalid number`},
+		{`cpu,host_id=1 usage=NaN`, time.Nanosecond, `invalid number`},
+		{`cpu,host_id=1 usage=1 yesterday`, time.Nanosecond, `invalid timestamp`},
+		{`cpu,host_id=1 usage=1 9223372036854775807`, time.Second, `timestamp out of range`},
+		{`cpu,host_id=1 usage=1 -9223372036854775807`, time.Minute, `timestamp out of range`},
+		{`cpu,host_id=1 usage=1 2562048`, time.Hour, `timestamp out of range`},
+	}
+
+	for _, tt := range tests {
+		_, err := parseLine(tt.line, time.Now(), tt.precision)
+		if err == nil {
+			t.Errorf("%s: expected error %q", tt.line, tt.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %q, expected %q", tt.line, err, tt.err)
+		}
+	}
+}
+
+func TestLinePrecision(t *testing.T) {
+	tests := map[string]time.Duration{
+		``:   time.Nanosecond,
+		`ns`: time.Nanosecond,
+		`u`:  time.Microsecond,
+		`ms`: time.Millisecond,
+		`s`:  time.Second,
+		`m`:  time.Minute,
+		`h`:  time.Hour,
+	}
+	for precision, want := range tests {
+		got, err := linePrecision(precision)
+		if err != nil || got != want {
+			t.Errorf("precision %q: %s, %v, expected %s", precision,
+				got, err, want)
+		}
+	}
+	if _, err := linePrecision(`d`); err == nil {
+		t.Error(`precision d: expected error`)
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		s      string
+		sep    byte
+		quoted bool
+		want   []string
+	}{
+		{`a b c`, ' ', false, []string{`a`, `b`, `c`}},
+		{`a\ b c`, ' ', false, []string{`a\ b`, `c`}},
+		{`a "b c" d`, ' ', true, []string{`a`, `"b c"`, `d`}},
+		{`a "b c" d`, ' ', false, []string{`a`, `"b`, `c"`, `d`}},
+		{`k=v=w`, '=', false, []string{`k`, `v=w`}},
+		{`k\=x=v`, '=', false, []string{`k\=x`, `v`}},
+		{`x="a \" b",y=1`, ',', true, []string{`x="a \" b"`, `y=1`}},
+	}
+	for _, tt := range tests {
+		if got := splitLine(tt.s, tt.sep, tt.quoted); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitLine(%q, %q, %t) = %q, expected %q", tt.s,
+				tt.sep, tt.quoted, got, tt.want)
+		}
+	}
+}
+
+func TestUnescapeLine(t *testing.T) {
+	tests := []struct {
+		s       string
+		escaped string
+		want    string
+	}{
+		{`plain`, `, `, `plain`},
+		{`a\,b\ c`, `, `, `a,b c`},
+		{`a\=b`, `, `, `a\=b`},
+		{`a\=b`, `,= `, `a=b`},
+		{`\"q\" \\`, `"\`, `"q" \`},
+		{`trailing\`, `, `, `trailing\`},
+	}
+	for _, tt := range tests {
+		if got := unescapeLine(tt.s, tt.escaped); got != tt.want {
+			t.Errorf("unescapeLine(%q, %q) = %q, expected %q", tt.s,
+				tt.escaped, got, tt.want)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -9,6 +9,8 @@
 package mistral // import "github.com/solnx/mistral/internal/mistral"
 
 import (
+	"time"
+
 	"github.com/Shopify/sarama"
 	"github.com/Sirupsen/logrus"
 	"github.com/mjolnir42/delay"
@@ -34,6 +36,26 @@ var shutdown bool
 // initialized true by the init function
 var startup bool
 
+// contextKey is the type for request context keys of this package
+type contextKey int
+
+const (
+	// asyncKey marks a request for asynchronous delivery
+	asyncKey contextKey = iota
+	// hostIDsKey holds the HostIDs a request is restricted to
+	hostIDsKey
+	// principalKey holds the authenticated client identity
+	principalKey
+	// signatureKey holds the signature of a signed request
+	signatureKey
+	// timingKey holds the requestTiming of a request
+	timingKey
+	// accessKey holds the access log entry of a request
+	accessKey
+	// connKey holds the connection a request was received on
+	connKey
+)
+
 func init() {
 	Handlers = make(map[int]erebos.Handler)
 	startup = true
@@ -41,17 +63,19 @@ func init() {
 
 // Mistral produces messages received via its HTTP handler to Kafka
 type Mistral struct {
-	Num      int
-	Input    chan *erebos.Transport
-	Shutdown chan struct{}
-	Death    chan error
-	Config   *erebos.Config
-	Metrics  *metrics.Registry
-	delay    *delay.Delay
-	trackID  map[string]*erebos.Transport
-	dispatch chan<- *sarama.ProducerMessage
-	producer sarama.AsyncProducer
-	lastErr  int
+	Num       int
+	Input     chan *erebos.Transport
+	Shutdown  chan struct{}
+	Death     chan error
+	Config    *Config
+	Metrics   *metrics.Registry
+	delay     *delay.Delay
+	trackID   map[string]*erebos.Transport
+	trackTime map[string]time.Time
+	dispatch  chan<- *sarama.ProducerMessage
+	producer  sarama.AsyncProducer
+	lastErr   int
+	txn       transaction
 }
 
 // SetUnavailable switches the private package variable to true
@@ -71,21 +95,48 @@ func StartupComplete() {
 
 // ackClientRequest updates the API client with the result of
 // the producer request
-func (m *Mistral) ackClientRequest(trackingID string, err error) {
+func (m *Mistral) ackClientRequest(msg *sarama.ProducerMessage, err error) {
+	trackingID := msg.Metadata.(string)
 	if _, ok := m.trackID[trackingID]; !ok {
 		logrus.Warnf("Unknown trackingID: %s", trackingID)
 		return
 	}
 
+	// with transactions the client request is acked once the
+	// transaction is finished
+	if m.producer.IsTransactional() {
+		m.holdForCommit(msg, err)
+		return
+	}
+	m.ack(msg, err)
+}
+
+// ack sends the result of the producer request to the API client
+func (m *Mistral) ack(msg *sarama.ProducerMessage, err error) {
+	trackingID := msg.Metadata.(string)
+
+	// record where the message was written to for clients waiting
+	// for a receipt
+	fillReceipt(requestFor(m.trackID[trackingID].Return), msg, err)
+	m.updateProduce(trackingID, err)
+
 	// ack client request
-	m.delay.Use()
-	go func(msg *erebos.Transport, err error) {
-		msg.Return <- err
-		m.delay.Done()
-	}(m.trackID[trackingID], err)
+	m.reply(m.trackID[trackingID], err)
 
 	// cleanup request tracking
 	delete(m.trackID, trackingID)
 }
 
+// reply sends the result err to the submitter of msg and releases
+// the state of the batch
+func (m *Mistral) reply(msg *erebos.Transport, err error) {
+	untrackRequest(msg.Return)
+
+	m.delay.Use()
+	go func() {
+		msg.Return <- err
+		m.delay.Done()
+	}()
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -10,6 +10,7 @@ package mistral // import "github.com/solnx/mistral/internal/mistral"
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/mjolnir42/erebos"
@@ -18,6 +19,14 @@ import (
 
 // process sends the received message to Kafka
 func (m *Mistral) process(msg *erebos.Transport) {
+	if m.producer.IsTransactional() && !m.admit(msg) {
+		return
+	}
+	st := requestFor(msg.Return)
+	m.updateQueueWait(st)
+	if m.aborted(msg, st) {
+		return
+	}
 	trackingID := uuid.Must(uuid.NewV4()).String()
 
 	m.delay.Use()
@@ -33,6 +42,7 @@ func (m *Mistral) process(msg *erebos.Transport) {
 		m.delay.Done()
 	}(int(msg.HostID), trackingID, msg.Value)
 	m.trackID[trackingID] = msg
+	m.trackTime[trackingID] = time.Now()
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -34,14 +34,15 @@ runloop:
 		case <-m.Shutdown:
 			goto drainloop
 		case msg := <-m.producer.Errors():
-			trackingID := msg.Msg.Metadata.(string)
 			err := msg.Err
-			m.ackClientRequest(trackingID, err)
+			m.ackClientRequest(msg.Msg, err)
 			mtr.Mark(1)
 			logrus.Errorf("Producer error: %s", err.Error())
 			// increase error counter
 			m.lastErr++
-			if m.lastErr >= 10 {
+			// with a disk spool the failed batches are kept for
+			// replay and the handler stays up
+			if m.lastErr >= 10 && Spooler == nil {
 				// shutdown on 10+ producer errors in a row
 				m.Death <- fmt.Errorf(
 					"Mistral[%d]: %d consecutive producer errors",
@@ -51,8 +52,7 @@ runloop:
 				break runloop
 			}
 		case msg := <-m.producer.Successes():
-			trackingID := msg.Metadata.(string)
-			m.ackClientRequest(trackingID, nil)
+			m.ackClientRequest(msg, nil)
 			mtr.Mark(1)
 			// reset error counter on success
 			m.lastErr = 0
@@ -64,6 +64,13 @@ runloop:
 			}
 			m.process(msg)
 		}
+
+		// a fenced transactional producer can not be used again
+		if err := m.txnFailed(); err != nil {
+			m.Death <- err
+			<-m.Shutdown
+			break runloop
+		}
 	}
 	m.producer.Close()
 	return
@@ -76,7 +83,8 @@ drainloop:
 			if msg == nil {
 				inputEmpty = true
 
-				if !producerClosed {
+				// open transactions are finished first
+				if !producerClosed && m.txnSettled() {
 					m.producer.Close()
 					producerClosed = true
 				}
@@ -98,11 +106,14 @@ drainloop:
 				}
 				continue drainloop
 			}
-			trackingID := msg.Msg.Metadata.(string)
 			err := msg.Err
-			m.ackClientRequest(trackingID, err)
+			m.ackClientRequest(msg.Msg, err)
 			mtr.Mark(1)
 			logrus.Errorf("Producer error: %s", err.Error())
+			if inputEmpty && !producerClosed && m.txnSettled() {
+				m.producer.Close()
+				producerClosed = true
+			}
 		case msg := <-m.producer.Successes():
 			if msg == nil {
 				successEmpty = true
@@ -113,9 +124,12 @@ drainloop:
 				}
 				continue drainloop
 			}
-			trackingID := msg.Metadata.(string)
-			m.ackClientRequest(trackingID, nil)
+			m.ackClientRequest(msg, nil)
 			mtr.Mark(1)
+			if inputEmpty && !producerClosed && m.txnSettled() {
+				m.producer.Close()
+				producerClosed = true
+			}
 		}
 	}
 	m.delay.Wait()
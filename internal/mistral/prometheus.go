@@ -0,0 +1,175 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// percentiles are exported for histograms and timers
+var percentiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// Metrics is the HTTP API endpoint that exports the Mistral metrics
+// and Go runtime statistics in Prometheus text exposition format
+func Metrics(w http.ResponseWriter, r *http.Request,
+	_ httprouter.Params) {
+
+	// count scrapes apart from the data requests
+	if MtrReg != nil {
+		mtr := metrics.GetOrRegisterMeter(`/requests/metrics`, *MtrReg)
+		mtr.Mark(1)
+	}
+
+	buf := &bytes.Buffer{}
+	if MtrReg != nil {
+		registered := map[string]interface{}{}
+		(*MtrReg).Each(func(name string, v interface{}) {
+			registered[name] = v
+		})
+		names := make([]string, 0, len(registered))
+		for name := range registered {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			writePromMetric(buf, promName(name), registered[name])
+		}
+	}
+	writePromRuntime(buf)
+
+	w.Header().Set(`Content-Type`, `text/plain; version=0.0.4; charset=utf-8`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// writePromMetric writes the go-metrics metric v in Prometheus text
+// exposition format
+func writePromMetric(buf *bytes.Buffer, name string, v interface{}) {
+	switch value := v.(type) {
+	case metrics.Counter:
+		writePromValue(buf, name, `gauge`, float64(value.Count()))
+	case metrics.Gauge:
+		writePromValue(buf, name, `gauge`, float64(value.Value()))
+	case metrics.GaugeFloat64:
+		writePromValue(buf, name, `gauge`, value.Value())
+	case metrics.Meter:
+		m := value.Snapshot()
+		writePromValue(buf, name+`_total`, `counter`, float64(m.Count()))
+		writePromValue(buf, name+`_rate1`, `gauge`, m.Rate1())
+		writePromValue(buf, name+`_rate5`, `gauge`, m.Rate5())
+		writePromValue(buf, name+`_rate15`, `gauge`, m.Rate15())
+		writePromValue(buf, name+`_rate_mean`, `gauge`, m.RateMean())
+	case metrics.Histogram:
+		h := value.Snapshot()
+		writePromSummary(buf, name, h.Percentiles(percentiles),
+			float64(h.Sum()), h.Count(), float64(h.Min()),
+			float64(h.Max()))
+	case metrics.Timer:
+		t := value.Snapshot()
+		ps := t.Percentiles(percentiles)
+		for i := range ps {
+			ps[i] = ps[i] / float64(time.Second)
+		}
+		writePromSummary(buf, name+`_seconds`, ps,
+			float64(t.Sum())/float64(time.Second), t.Count(),
+			float64(t.Min())/float64(time.Second),
+			float64(t.Max())/float64(time.Second))
+		writePromValue(buf, name+`_rate1`, `gauge`, t.Rate1())
+	}
+}
+
+// writePromValue writes a single sample metric
+func writePromValue(buf *bytes.Buffer, name, kind string, value float64) {
+	fmt.Fprintf(buf, "# TYPE %s %s\n%s %g\n", name, kind, name, value)
+}
+
+// writePromSummary writes a summary with the quantiles ps and the
+// minimum and maximum as separate gauges
+func writePromSummary(buf *bytes.Buffer, name string, ps []float64,
+	sum float64, count int64, min, max float64) {
+
+	fmt.Fprintf(buf, "# TYPE %s summary\n", name)
+	for i, p := range percentiles {
+		fmt.Fprintf(buf, "%s{quantile=\"%g\"} %g\n", name, p, ps[i])
+	}
+	fmt.Fprintf(buf, "%s_sum %g\n%s_count %d\n", name, sum, name, count)
+	writePromValue(buf, name+`_min`, `gauge`, min)
+	writePromValue(buf, name+`_max`, `gauge`, max)
+}
+
+// writePromRuntime writes the Go runtime statistics
+func writePromRuntime(buf *bytes.Buffer) {
+	mem := runtime.MemStats{}
+	runtime.ReadMemStats(&mem)
+
+	fmt.Fprintf(buf, "# TYPE go_info gauge\ngo_info{version=\"%s\"} 1\n",
+		runtime.Version())
+	writePromValue(buf, `go_goroutines`, `gauge`,
+		float64(runtime.NumGoroutine()))
+	writePromValue(buf, `go_threads`, `gauge`,
+		float64(pprof.Lookup(`threadcreate`).Count()))
+	writePromValue(buf, `go_memstats_alloc_bytes`, `gauge`,
+		float64(mem.Alloc))
+	writePromValue(buf, `go_memstats_alloc_bytes_total`, `counter`,
+		float64(mem.TotalAlloc))
+	writePromValue(buf, `go_memstats_sys_bytes`, `gauge`,
+		float64(mem.Sys))
+	writePromValue(buf, `go_memstats_mallocs_total`, `counter`,
+		float64(mem.Mallocs))
+	writePromValue(buf, `go_memstats_frees_total`, `counter`,
+		float64(mem.Frees))
+	writePromValue(buf, `go_memstats_heap_alloc_bytes`, `gauge`,
+		float64(mem.HeapAlloc))
+	writePromValue(buf, `go_memstats_heap_idle_bytes`, `gauge`,
+		float64(mem.HeapIdle))
+	writePromValue(buf, `go_memstats_heap_inuse_bytes`, `gauge`,
+		float64(mem.HeapInuse))
+	writePromValue(buf, `go_memstats_heap_objects`, `gauge`,
+		float64(mem.HeapObjects))
+	writePromValue(buf, `go_memstats_stack_inuse_bytes`, `gauge`,
+		float64(mem.StackInuse))
+	writePromValue(buf, `go_memstats_next_gc_bytes`, `gauge`,
+		float64(mem.NextGC))
+	writePromValue(buf, `go_memstats_last_gc_time_seconds`, `gauge`,
+		float64(mem.LastGC)/float64(time.Second))
+	writePromValue(buf, `go_gc_cycles_total`, `counter`,
+		float64(mem.NumGC))
+	writePromValue(buf, `go_gc_pause_seconds_total`, `counter`,
+		float64(mem.PauseTotalNs)/float64(time.Second))
+}
+
+// promName converts a go-metrics name like /mistral/requests into a
+// valid Prometheus metric name like mistral_requests
+func promName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '_', r == ':':
+			return r
+		}
+		return '_'
+	}, name)
+	name = strings.Trim(name, `_`)
+	if name == `` || (name[0] >= '0' && name[0] <= '9') {
+		name = `_` + name
+	}
+	return name
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,40 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+// Receipt describes where a batch was produced to
+type Receipt struct {
+	Topic      string `json:"topic"`
+	Partition  int32  `json:"partition"`
+	Offset     int64  `json:"offset"`
+	TrackingID string `json:"tracking_id"`
+}
+
+// fillReceipt records the production result of msg in the receipt
+// of st if one is expected. Partition and offset are only known if
+// producing succeeded. The submitter reads the receipt after
+// receiving the result.
+func fillReceipt(st *requestState, msg *sarama.ProducerMessage, err error) {
+	if st == nil || st.receipt == nil {
+		return
+	}
+	rcpt := st.receipt
+	rcpt.Topic = msg.Topic
+	rcpt.TrackingID, _ = msg.Metadata.(string)
+	if err == nil {
+		rcpt.Partition = msg.Partition
+		rcpt.Offset = msg.Offset
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
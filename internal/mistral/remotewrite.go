@@ -0,0 +1,371 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/snappy"
+	"github.com/julienschmidt/httprouter"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/legacy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriteHostLabel is the name of the label that carries the
+// HostID of a time series received via RemoteWrite
+var RemoteWriteHostLabel = `host_id`
+
+// promSeries is a time series of a Prometheus remote_write request
+type promSeries struct {
+	labels  map[string]string
+	samples []promSample
+}
+
+// promSample is a single sample of a promSeries
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+// RemoteWrite is the HTTP API endpoint for Prometheus remote_write
+// requests. The received time series are converted into one
+// legacy.MetricBatch per HostID.
+func RemoteWrite(w http.ResponseWriter, r *http.Request,
+	params httprouter.Params) {
+
+	// remote_write bodies are always snappy compressed and declared
+	// as such in the Content-Encoding header
+	compressed, ok := readRequest(w, r, `snappy`)
+	if !ok {
+		return
+	}
+
+	if size, err := snappy.DecodedLen(compressed); err == nil &&
+		int64(size) > MaxDecompressedSize {
+		logrus.Warningf(
+			"Rejected remote_write data from %s: decompressed size %d exceeds %d bytes",
+			r.RemoteAddr, size, MaxDecompressedSize)
+		markRejected(`/rejected/body_size`)
+
+		http.Error(w,
+			http.StatusText(http.StatusRequestEntityTooLarge),
+			http.StatusRequestEntityTooLarge,
+		)
+		return
+	}
+
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		logrus.Warningf(
+			"snappy.Decode: rejected undecodable data from %s: %s",
+			r.RemoteAddr, err.Error())
+
+		http.Error(w,
+			err.Error(),
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	series, err := decodeWriteRequest(buf)
+	if err != nil {
+		logrus.Warningf(
+			"decodeWriteRequest: rejected unprocessable data from %s: %s",
+			r.RemoteAddr, err.Error())
+
+		http.Error(w,
+			err.Error(),
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	batches, hostless := convertPromSeries(r, series)
+	decoded(r)
+
+	// like HostID 0 in the JSON endpoint, data without any valid
+	// HostID is rejected instead of silently dropped
+	if len(batches) == 0 && hostless > 0 {
+		logrus.Warningf(
+			"Rejected remote_write data from %s: no time series with valid %s label",
+			r.RemoteAddr, RemoteWriteHostLabel)
+		deadLetter(`missing or invalid `+RemoteWriteHostLabel+` label`,
+			r.RemoteAddr, 0, buf)
+
+		http.Error(w,
+			http.StatusText(http.StatusBadRequest),
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	// send data to application handlers for kafka production
+	status := deliverBatches(r, batches)
+	if status != http.StatusOK && status != http.StatusAccepted {
+		if status == http.StatusTooManyRequests {
+			setRetryAfter(w)
+		}
+		http.Error(w,
+			http.StatusText(status),
+			status,
+		)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(nil)
+}
+
+// convertPromSeries converts the received time series into one
+// legacy.MetricBatch per HostID. Series without a valid HostID and
+// samples that can not be represented in JSON are dropped. It also
+// returns the number of samples dropped for lack of a valid HostID.
+func convertPromSeries(r *http.Request,
+	series []promSeries) (map[int]*legacy.MetricBatch, int) {
+
+	batches := make(map[int]*legacy.MetricBatch)
+	// index of the MetricData for a timestamp within a batch
+	index := make(map[int]map[int64]int)
+	dropped := 0
+	hostless := 0
+
+	for _, s := range series {
+		hostID, err := strconv.Atoi(s.labels[RemoteWriteHostLabel])
+		if err != nil || hostID <= 0 {
+			dropped += len(s.samples)
+			hostless += len(s.samples)
+			continue
+		}
+
+		tags := make([]string, 0, len(s.labels))
+		for name, value := range s.labels {
+			switch name {
+			case `__name__`, RemoteWriteHostLabel:
+				continue
+			}
+			tags = append(tags, fmt.Sprintf("%s=%s", name, value))
+		}
+		sort.Strings(tags)
+
+		if _, ok := batches[hostID]; !ok {
+			batches[hostID] = &legacy.MetricBatch{
+				HostID: hostID,
+				Data:   []legacy.MetricData{},
+			}
+			index[hostID] = make(map[int64]int)
+		}
+		batch := batches[hostID]
+
+		for _, sample := range s.samples {
+			// NaN is used by Prometheus as staleness marker
+			if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+				dropped++
+				continue
+			}
+
+			i, ok := index[hostID][sample.timestamp]
+			if !ok {
+				batch.Data = append(batch.Data, legacy.MetricData{
+					Time: time.Unix(0,
+						sample.timestamp*int64(time.Millisecond)).UTC(),
+					Metrics: []legacy.Metric{},
+				})
+				i = len(batch.Data) - 1
+				index[hostID][sample.timestamp] = i
+			}
+			batch.Data[i].Metrics = append(batch.Data[i].Metrics,
+				legacy.Metric{
+					Metric: s.labels[`__name__`],
+					Type:   `real`,
+					Tags:   tags,
+					Value: legacy.MetricValue{
+						FlpVal: sample.value,
+					},
+				})
+		}
+	}
+
+	if dropped > 0 {
+		logrus.Warningf("Dropped %d remote_write samples from %s without valid HostID or value",
+			dropped, r.RemoteAddr)
+		if MtrReg != nil {
+			mtr := metrics.GetOrRegisterMeter(`/remote_write/dropped`,
+				*MtrReg)
+			mtr.Mark(int64(dropped))
+		}
+	}
+	return batches, hostless
+}
+
+// decodeWriteRequest decodes the time series of a protobuf encoded
+// prometheus.WriteRequest
+func decodeWriteRequest(buf []byte) ([]promSeries, error) {
+	series := []promSeries{}
+
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		buf = buf[n:]
+
+		// field 1: repeated TimeSeries timeseries
+		if num == 1 && typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(buf)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			s, err := decodeTimeSeries(v)
+			if err != nil {
+				return nil, err
+			}
+			series = append(series, s)
+			buf = buf[m:]
+			continue
+		}
+
+		m := protowire.ConsumeFieldValue(num, typ, buf)
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		buf = buf[m:]
+	}
+	return series, nil
+}
+
+// decodeTimeSeries decodes a protobuf encoded prometheus.TimeSeries
+func decodeTimeSeries(buf []byte) (promSeries, error) {
+	s := promSeries{
+		labels:  make(map[string]string),
+		samples: []promSample{},
+	}
+
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return s, protowire.ParseError(n)
+		}
+		buf = buf[n:]
+
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			m := protowire.ConsumeFieldValue(num, typ, buf)
+			if m < 0 {
+				return s, protowire.ParseError(m)
+			}
+			buf = buf[m:]
+			continue
+		}
+
+		v, m := protowire.ConsumeBytes(buf)
+		if m < 0 {
+			return s, protowire.ParseError(m)
+		}
+		buf = buf[m:]
+
+		switch num {
+		case 1:
+			// field 1: repeated Label labels
+			name, value, err := decodeLabel(v)
+			if err != nil {
+				return s, err
+			}
+			s.labels[name] = value
+		case 2:
+			// field 2: repeated Sample samples
+			sample, err := decodeSample(v)
+			if err != nil {
+				return s, err
+			}
+			s.samples = append(s.samples, sample)
+		}
+	}
+	return s, nil
+}
+
+// decodeLabel decodes a protobuf encoded prometheus.Label
+func decodeLabel(buf []byte) (string, string, error) {
+	var name, value string
+
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return ``, ``, protowire.ParseError(n)
+		}
+		buf = buf[n:]
+
+		if typ == protowire.BytesType && (num == 1 || num == 2) {
+			v, m := protowire.ConsumeString(buf)
+			if m < 0 {
+				return ``, ``, protowire.ParseError(m)
+			}
+			buf = buf[m:]
+			if num == 1 {
+				name = v
+			} else {
+				value = v
+			}
+			continue
+		}
+
+		m := protowire.ConsumeFieldValue(num, typ, buf)
+		if m < 0 {
+			return ``, ``, protowire.ParseError(m)
+		}
+		buf = buf[m:]
+	}
+	return name, value, nil
+}
+
+// decodeSample decodes a protobuf encoded prometheus.Sample
+func decodeSample(buf []byte) (promSample, error) {
+	sample := promSample{}
+
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return sample, protowire.ParseError(n)
+		}
+		buf = buf[n:]
+
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			// field 1: double value
+			v, m := protowire.ConsumeFixed64(buf)
+			if m < 0 {
+				return sample, protowire.ParseError(m)
+			}
+			sample.value = math.Float64frombits(v)
+			buf = buf[m:]
+		case num == 2 && typ == protowire.VarintType:
+			// field 2: int64 timestamp in milliseconds
+			v, m := protowire.ConsumeVarint(buf)
+			if m < 0 {
+				return sample, protowire.ParseError(m)
+			}
+			sample.timestamp = int64(v)
+			buf = buf[m:]
+		default:
+			m := protowire.ConsumeFieldValue(num, typ, buf)
+			if m < 0 {
+				return sample, protowire.ParseError(m)
+			}
+			buf = buf[m:]
+		}
+	}
+	return sample, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,177 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// appendLabel appends a protobuf encoded prometheus.Label
+func appendLabel(buf []byte, name, value string) []byte {
+	var label []byte
+	label = protowire.AppendTag(label, 1, protowire.BytesType)
+	label = protowire.AppendString(label, name)
+	label = protowire.AppendTag(label, 2, protowire.BytesType)
+	label = protowire.AppendString(label, value)
+
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	return protowire.AppendBytes(buf, label)
+}
+
+// appendSample appends a protobuf encoded prometheus.Sample
+func appendSample(buf []byte, value float64, timestamp int64) []byte {
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp))
+
+	buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+	return protowire.AppendBytes(buf, sample)
+}
+
+// appendSeries appends a protobuf encoded prometheus.TimeSeries
+func appendSeries(buf []byte, series []byte) []byte {
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	return protowire.AppendBytes(buf, series)
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	var first []byte
+	first = appendLabel(first, `__name__`, `cpu_usage`)
+	first = appendLabel(first, `host_id`, `42`)
+	first = appendSample(first, 0.5, 1496318400000)
+	first = appendSample(first, 0.75, 1496318460000)
+	// an unknown field is skipped
+	first = protowire.AppendTag(first, 9, protowire.VarintType)
+	first = protowire.AppendVarint(first, 1)
+
+	var second []byte
+	second = appendLabel(second, `__name__`, `mem_used`)
+	second = appendSample(second, 1024, 1496318400000)
+
+	var req []byte
+	req = appendSeries(req, first)
+	req = appendSeries(req, second)
+	// metadata, field 3 of the WriteRequest, is skipped
+	req = protowire.AppendTag(req, 3, protowire.BytesType)
+	req = protowire.AppendBytes(req, []byte{0x08, 0x01})
+
+	series, err := decodeWriteRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []promSeries{
+		{
+			labels: map[string]string{
+				`__name__`: `cpu_usage`,
+				`host_id`:  `42`,
+			},
+			samples: []promSample{
+				{value: 0.5, timestamp: 1496318400000},
+				{value: 0.75, timestamp: 1496318460000},
+			},
+		},
+		{
+			labels:  map[string]string{`__name__`: `mem_used`},
+			samples: []promSample{{value: 1024, timestamp: 1496318400000}},
+		},
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Fatalf("decoded %+v, expected %+v", series, want)
+	}
+}
+
+func TestDecodeWriteRequestMalformed(t *testing.T) {
+	var series []byte
+	series = appendLabel(series, `host_id`, `1`)
+	series = appendSample(series, 1, 1)
+	var req []byte
+	req = appendSeries(req, series)
+
+	tests := map[string][]byte{
+		`truncated request`: req[:len(req)-3],
+		`truncated tag`:     {0x80},
+		`truncated series`:  appendSeries(nil, series[:len(series)-2]),
+		`invalid wire type`: {0x0f},
+	}
+	for name, buf := range tests {
+		if _, err := decodeWriteRequest(buf); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestConvertPromSeries(t *testing.T) {
+	r := httptest.NewRequest(`POST`, `/api/v1/prometheus/write`, nil)
+	series := []promSeries{
+		{
+			labels: map[string]string{
+				`__name__`: `cpu_usage`,
+				`host_id`:  `42`,
+				`core`:     `0`,
+			},
+			samples: []promSample{
+				{value: 0.5, timestamp: 1496318400000},
+				{value: math.NaN(), timestamp: 1496318460000},
+			},
+		},
+		{
+			labels: map[string]string{
+				`__name__`: `cpu_usage`,
+				`host_id`:  `42`,
+				`core`:     `1`,
+			},
+			samples: []promSample{{value: 0.25, timestamp: 1496318400000}},
+		},
+		{
+			labels:  map[string]string{`__name__`: `no_host`},
+			samples: []promSample{{value: 1, timestamp: 1}},
+		},
+		{
+			labels: map[string]string{
+				`__name__`: `bad_host`,
+				`host_id`:  `0`,
+			},
+			samples: []promSample{{value: 1, timestamp: 1}, {value: 2, timestamp: 2}},
+		},
+	}
+
+	batches, hostless := convertPromSeries(r, series)
+	if hostless != 3 {
+		t.Errorf("%d samples without HostID, expected 3", hostless)
+	}
+	if len(batches) != 1 || batches[42] == nil {
+		t.Fatalf("converted %d batches, expected one for HostID 42", len(batches))
+	}
+
+	// samples with the same timestamp share their MetricData
+	data := batches[42].Data
+	if len(data) != 1 || len(data[0].Metrics) != 2 {
+		t.Fatalf("converted %+v, expected one timestamp with two metrics", data)
+	}
+	for i, core := range []string{`core=0`, `core=1`} {
+		m := data[0].Metrics[i]
+		if m.Metric != `cpu_usage` || !reflect.DeepEqual(m.Tags, []string{core}) {
+			t.Errorf("metric %d is %+v, expected cpu_usage with %s", i, m, core)
+		}
+	}
+
+	_, hostless = convertPromSeries(r, series[2:])
+	if hostless != 3 {
+		t.Errorf("%d samples without HostID, expected 3", hostless)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
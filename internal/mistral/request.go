@@ -0,0 +1,64 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// requestState is the state of a queued batch that is shared between
+// the submitter of the batch and its application handler
+type requestState struct {
+	// ctx is the context of the submitting request if the batch is
+	// dropped once the client disconnects
+	ctx context.Context
+	// queuedAt is the time the batch was queued for the handler
+	queuedAt time.Time
+	// receipt is filled with the production result if the submitter
+	// expects one
+	receipt *Receipt
+}
+
+// requests holds the state of every queued batch until it is acked.
+// It is keyed by the Return channel of the erebos.Transport, which
+// is the only part of the Transport shared with the handler since
+// Dispatch receives it by value.
+var requests = struct {
+	sync.Mutex
+	m map[chan error]*requestState
+}{m: make(map[chan error]*requestState)}
+
+// trackRequest registers st as state of the batch with the result
+// channel ret, which is queued now
+func trackRequest(ret chan error, st *requestState) {
+	st.queuedAt = time.Now()
+	requests.Lock()
+	requests.m[ret] = st
+	requests.Unlock()
+}
+
+// requestFor returns the state of the batch with the result channel
+// ret or nil if it is unknown
+func requestFor(ret chan error) *requestState {
+	requests.Lock()
+	defer requests.Unlock()
+	return requests.m[ret]
+}
+
+// untrackRequest removes the state of the batch with the result
+// channel ret, once it is acked or could not be queued
+func untrackRequest(ret chan error) {
+	requests.Lock()
+	delete(requests.m, ret)
+	requests.Unlock()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,54 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// scramClient implements sarama.SCRAMClient
+type scramClient struct {
+	hash scram.HashGeneratorFcn
+	conv *scram.ClientConversation
+}
+
+// newSCRAMSHA256Client returns a sarama.SCRAMClient for
+// SCRAM-SHA-256
+func newSCRAMSHA256Client() sarama.SCRAMClient {
+	return &scramClient{hash: scram.SHA256}
+}
+
+// newSCRAMSHA512Client returns a sarama.SCRAMClient for
+// SCRAM-SHA-512
+func newSCRAMSHA512Client() sarama.SCRAMClient {
+	return &scramClient{hash: scram.SHA512}
+}
+
+// Begin starts the SCRAM conversation
+func (s *scramClient) Begin(userName, password, authzID string) error {
+	client, err := s.hash.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	s.conv = client.NewConversation()
+	return nil
+}
+
+// Step answers a challenge of the server
+func (s *scramClient) Step(challenge string) (string, error) {
+	return s.conv.Step(challenge)
+}
+
+// Done returns true once the SCRAM conversation is complete
+func (s *scramClient) Done() bool {
+	return s.conv.Done()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
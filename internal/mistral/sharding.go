@@ -0,0 +1,84 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"fmt"
+)
+
+// shard returns the number of the handler out of n handlers that
+// processes all batches of hostID
+var shard = shardModulo
+
+// SetSharding selects the strategy that assigns HostIDs to handlers:
+//
+//	modulo:     HostID modulo the number of handlers (default)
+//	jump:       jump consistent hash
+//	rendezvous: highest random weight hashing
+//
+// Every strategy maps a HostID to a single handler, which keeps the
+// batches of a host in order.
+func SetSharding(strategy string) error {
+	switch strategy {
+	case ``, `modulo`:
+		shard = shardModulo
+	case `jump`:
+		shard = shardJump
+	case `rendezvous`:
+		shard = shardRendezvous
+	default:
+		return fmt.Errorf("Unknown sharding strategy: %s", strategy)
+	}
+	return nil
+}
+
+// shardModulo assigns HostIDs to handlers round robin
+func shardModulo(hostID, n int) int {
+	return hostID % n
+}
+
+// shardJump assigns HostIDs via the jump consistent hash by Lamping
+// and Veach. Hot HostIDs that are adjacent are spread over the
+// handlers.
+func shardJump(hostID, n int) int {
+	key := mix64(uint64(hostID))
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) /
+			float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// shardRendezvous assigns HostIDs to the handler with the highest
+// hash of HostID and handler number
+func shardRendezvous(hostID, n int) int {
+	best, weight := 0, uint64(0)
+	for i := 0; i < n; i++ {
+		if w := mix64(uint64(hostID)<<32 ^ uint64(i)); i == 0 || w > weight {
+			best, weight = i, w
+		}
+	}
+	return best
+}
+
+// mix64 is the splitmix64 finalizer, used to spread sequential
+// HostIDs over the hash space
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,140 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetSharding(t *testing.T) {
+	defer SetSharding(``)
+
+	tests := []struct {
+		strategy string
+		want     func(int, int) int
+	}{
+		{``, shardModulo},
+		{`modulo`, shardModulo},
+		{`jump`, shardJump},
+		{`rendezvous`, shardRendezvous},
+	}
+	for _, tt := range tests {
+		if err := SetSharding(tt.strategy); err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.strategy, err)
+			continue
+		}
+		if reflect.ValueOf(shard).Pointer() !=
+			reflect.ValueOf(tt.want).Pointer() {
+			t.Errorf("%q: wrong sharding function selected", tt.strategy)
+		}
+	}
+
+	if err := SetSharding(`random`); err == nil {
+		t.Error(`unknown strategy random was accepted`)
+	}
+}
+
+func TestShardRange(t *testing.T) {
+	strategies := map[string]func(int, int) int{
+		`modulo`:     shardModulo,
+		`jump`:       shardJump,
+		`rendezvous`: shardRendezvous,
+	}
+	for name, fn := range strategies {
+		for _, n := range []int{1, 2, 7, 64} {
+			used := make(map[int]bool)
+			for hostID := 1; hostID <= 10000; hostID++ {
+				h := fn(hostID, n)
+				if h < 0 || h >= n {
+					t.Fatalf("%s: HostID %d assigned to handler %d of %d",
+						name, hostID, h, n)
+				}
+				// a HostID always maps to the same handler, which keeps
+				// its batches in order
+				if fn(hostID, n) != h {
+					t.Fatalf("%s: HostID %d moved between handlers",
+						name, hostID)
+				}
+				used[h] = true
+			}
+			if len(used) != n {
+				t.Errorf("%s: %d HostIDs use %d of %d handlers", name,
+					10000, len(used), n)
+			}
+		}
+	}
+}
+
+func TestShardModulo(t *testing.T) {
+	tests := []struct {
+		hostID, n, want int
+	}{
+		{0, 4, 0},
+		{5, 4, 1},
+		{42, 8, 2},
+		{42, 1, 0},
+	}
+	for _, tt := range tests {
+		if got := shardModulo(tt.hostID, tt.n); got != tt.want {
+			t.Errorf("HostID %d of %d handlers: %d, expected %d",
+				tt.hostID, tt.n, got, tt.want)
+		}
+	}
+}
+
+// TestShardAdjacent checks that the hashing strategies spread a run
+// of adjacent hot HostIDs, which modulo assigns round robin
+func TestShardAdjacent(t *testing.T) {
+	for name, fn := range map[string]func(int, int) int{
+		`jump`:       shardJump,
+		`rendezvous`: shardRendezvous,
+	} {
+		same := 0
+		for hostID := 1000; hostID < 1008; hostID++ {
+			if fn(hostID, 8) == shardModulo(hostID, 8) {
+				same++
+			}
+		}
+		if same == 8 {
+			t.Errorf("%s: adjacent HostIDs are assigned round robin", name)
+		}
+	}
+}
+
+func TestShardJumpConsistent(t *testing.T) {
+	// growing from n to n+1 handlers only moves HostIDs to the new
+	// handler
+	for hostID := 1; hostID <= 10000; hostID++ {
+		for n := 1; n < 16; n++ {
+			before, after := shardJump(hostID, n), shardJump(hostID, n+1)
+			if before != after && after != n {
+				t.Fatalf("HostID %d moved from %d to %d when adding handler %d",
+					hostID, before, after, n)
+			}
+		}
+	}
+}
+
+func TestShardRendezvousConsistent(t *testing.T) {
+	// growing from n to n+1 handlers only moves HostIDs to the new
+	// handler
+	for hostID := 1; hostID <= 10000; hostID++ {
+		for n := 1; n < 16; n++ {
+			before, after := shardRendezvous(hostID, n),
+				shardRendezvous(hostID, n+1)
+			if before != after && after != n {
+				t.Fatalf("HostID %d moved from %d to %d when adding handler %d",
+					hostID, before, after, n)
+			}
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
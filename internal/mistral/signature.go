@@ -0,0 +1,262 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// HostKeys holds the shared secrets for signed requests
+var HostKeys *KeyFile
+
+// SignatureWindow is the maximum clock difference between a signed
+// request's timestamp and the server. Signatures of delivered
+// requests are remembered until they fall outside of it to reject
+// replays.
+var SignatureWindow = 5 * time.Minute
+
+// seenSignatures holds the signatures of recently delivered requests
+// and of requests that are being delivered
+var seenSignatures = struct {
+	sync.Mutex
+	m      map[string]time.Time
+	pruned time.Time
+}{m: make(map[string]time.Time)}
+
+// KeyFile maps HostIDs to the shared secrets their requests are
+// signed with
+type KeyFile struct {
+	path string
+	mux  sync.RWMutex
+	keys map[int][]byte
+}
+
+// signedRequest holds the signature of a request and a copy of its
+// body as received. Once a batch of the request is delivered, the
+// signature is claimed for it until the delivery of one of its
+// batches fails.
+type signedRequest struct {
+	timestamp string
+	signature []byte
+	body      bytes.Buffer
+	claimed   bool
+	released  bool
+}
+
+// NewKeyFile reads the shared secrets from path. Every line holds a
+// HostID followed by its secret.
+func NewKeyFile(path string) (*KeyFile, error) {
+	k := &KeyFile{
+		path: path,
+		keys: make(map[int][]byte),
+	}
+	return k, k.Reload()
+}
+
+// Reload reads the key file again. The current keys stay active if
+// it can not be parsed.
+func (k *KeyFile) Reload() error {
+	fh, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	keys := make(map[int][]byte)
+	scanner := bufio.NewScanner(fh)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == `` || strings.HasPrefix(text, `#`) {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: invalid entry", k.path, line)
+		}
+		hostID, err := strconv.Atoi(fields[0])
+		if err != nil || hostID <= 0 {
+			return fmt.Errorf("%s:%d: invalid HostID %s",
+				k.path, line, fields[0])
+		}
+		keys[hostID] = []byte(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	k.mux.Lock()
+	k.keys = keys
+	k.mux.Unlock()
+	logrus.Infof("Loaded %d host keys from %s", len(keys), k.path)
+	return nil
+}
+
+// key returns the shared secret of hostID
+func (k *KeyFile) key(hostID int) ([]byte, bool) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	key, ok := k.keys[hostID]
+	return key, ok
+}
+
+// RequireSignature returns a copy of r whose batches are only
+// accepted if signature is the hex encoded HMAC-SHA256 over
+// timestamp, a newline and the request body as received, keyed with
+// the secret of the batch HostID. The signature can only be checked
+// once the HostID is known, so the body is recorded while the
+// endpoint reads it.
+func RequireSignature(r *http.Request, timestamp string,
+	signature []byte) *http.Request {
+
+	sr := &signedRequest{
+		timestamp: timestamp,
+		signature: signature,
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.TeeReader(r.Body, &sr.body),
+		Closer: r.Body,
+	}
+	ctx := context.WithValue(r.Context(), signatureKey, sr)
+	return r.WithContext(ctx)
+}
+
+// isSigned returns true if r requires a signature
+func isSigned(r *http.Request) bool {
+	_, ok := r.Context().Value(signatureKey).(*signedRequest)
+	return ok
+}
+
+// signatureValid returns true if r does not require a signature or
+// is signed with the secret of hostID. Replays are detected once the
+// batch is delivered, so that retries of failed requests and
+// duplicates suppressed by the Idempotency cache are not rejected.
+func signatureValid(r *http.Request, hostID int) bool {
+	sr, ok := r.Context().Value(signatureKey).(*signedRequest)
+	if !ok {
+		return true
+	}
+	if HostKeys == nil {
+		return false
+	}
+	key, ok := HostKeys.key(hostID)
+	if !ok {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sr.timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write(sr.body.Bytes())
+	if !hmac.Equal(mac.Sum(nil), sr.signature) {
+		return false
+	}
+	logPrincipal(r, hostPrincipal(hostID))
+	return true
+}
+
+// rejectSignature logs and counts a request with an invalid or
+// replayed signature
+func rejectSignature(r *http.Request, hostID int, reason string) {
+	logrus.Warningf("Rejected signature for HostID %d from %s: %s",
+		hostID, r.RemoteAddr, reason)
+	if MtrReg != nil {
+		metrics.GetOrRegisterMeter(`/authentication/failed`, *MtrReg).Mark(1)
+	}
+}
+
+// hostPrincipal returns the principal of requests signed with the
+// secret of hostID
+func hostPrincipal(hostID int) string {
+	return `host:` + strconv.Itoa(hostID)
+}
+
+// claimSignature returns false if the signature of r was used by
+// another request that was delivered or is being delivered. Within
+// the window, which covers timestamps in the past and in the future,
+// a signature is claimed by one request at a time.
+func claimSignature(r *http.Request) bool {
+	sr, ok := r.Context().Value(signatureKey).(*signedRequest)
+	if !ok {
+		return true
+	}
+
+	now := time.Now()
+	sig := string(sr.signature)
+	seenSignatures.Lock()
+	defer seenSignatures.Unlock()
+	// batches of further HostIDs in the same request
+	if sr.claimed {
+		return true
+	}
+	if _, seen := seenSignatures.m[sig]; seen {
+		return false
+	}
+	if now.Sub(seenSignatures.pruned) > SignatureWindow {
+		for s, t := range seenSignatures.m {
+			if now.Sub(t) > 2*SignatureWindow {
+				delete(seenSignatures.m, s)
+			}
+		}
+		seenSignatures.pruned = now
+	}
+	seenSignatures.m[sig] = now
+	sr.claimed = true
+	return true
+}
+
+// releaseSignature makes the signature of r available again after
+// the delivery of one of its batches failed, so that the client can
+// retry the request
+func releaseSignature(r *http.Request) {
+	sr, ok := r.Context().Value(signatureKey).(*signedRequest)
+	if !ok {
+		return
+	}
+
+	seenSignatures.Lock()
+	defer seenSignatures.Unlock()
+	if sr.claimed && !sr.released {
+		delete(seenSignatures.m, string(sr.signature))
+		sr.released = true
+	}
+}
+
+// deliverSigned delivers data like deliver, unless the signature of
+// r was replayed
+func deliverSigned(r *http.Request, hostID int, data []byte) (int, *Receipt) {
+	if !claimSignature(r) {
+		rejectSignature(r, hostID, `replayed signature`)
+		return http.StatusUnauthorized, nil
+	}
+	status, rcpt := deliver(r, hostID, data)
+	if status != http.StatusOK && status != http.StatusAccepted {
+		releaseSignature(r)
+	}
+	return status, rcpt
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,168 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHostKeys sets HostKeys to the secrets secret42 and secret43 of
+// the HostIDs 42 and 43 for the duration of a test
+func testHostKeys(t *testing.T) {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `mistral-hmac`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, `hmac.keys`)
+	if err := ioutil.WriteFile(path,
+		[]byte("# keys\n42 secret42\n43 secret43\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	HostKeys = keys
+	t.Cleanup(func() {
+		HostKeys = nil
+		// forget the signatures claimed by the test
+		seenSignatures.Lock()
+		seenSignatures.m = make(map[string]time.Time)
+		seenSignatures.Unlock()
+	})
+}
+
+// sign returns the HMAC-SHA256 over timestamp, a newline and body
+func sign(secret, timestamp, body string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + body))
+	return mac.Sum(nil)
+}
+
+// signedTestRequest returns a request with body that requires
+// signature, after the endpoint read its body
+func signedTestRequest(t *testing.T, timestamp, body string,
+	signature []byte) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(`POST`, `/api/metrics`, strings.NewReader(body))
+	r = RequireSignature(r, timestamp, signature)
+	if _, err := ioutil.ReadAll(r.Body); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestSignatureValid(t *testing.T) {
+	testHostKeys(t)
+	const body = `{"hostID":42}`
+
+	tests := []struct {
+		name      string
+		hostID    int
+		body      string
+		signature []byte
+		valid     bool
+	}{
+		{`valid signature`, 42, body, sign(`secret42`, `1000`, body), true},
+		{`tampered body`, 42, `{"hostID":42 }`, sign(`secret42`, `1000`, body), false},
+		{`tampered timestamp`, 42, body, sign(`secret42`, `1001`, body), false},
+		{`secret of another HostID`, 42, body, sign(`secret43`, `1000`, body), false},
+		{`HostID without secret`, 44, body, sign(`secret42`, `1000`, body), false},
+		{`truncated signature`, 42, body, sign(`secret42`, `1000`, body)[:16], false},
+	}
+	for _, tt := range tests {
+		r := signedTestRequest(t, `1000`, tt.body, tt.signature)
+		if got := signatureValid(r, tt.hostID); got != tt.valid {
+			t.Errorf("%s: %t, expected %t", tt.name, got, tt.valid)
+		}
+	}
+
+	// requests of other authentication styles are not signed
+	if !signatureValid(httptest.NewRequest(`POST`, `/`, nil), 42) {
+		t.Error(`unsigned request was rejected`)
+	}
+}
+
+func TestSignatureReplay(t *testing.T) {
+	testHostKeys(t)
+	const body = `{"hostID":42}`
+	signature := sign(`secret42`, `2000`, body)
+
+	first := signedTestRequest(t, `2000`, body, signature)
+	if !claimSignature(first) {
+		t.Fatal(`first request could not claim its signature`)
+	}
+	// further batches of the same request
+	if !claimSignature(first) {
+		t.Fatal(`second batch of the first request was rejected`)
+	}
+
+	// a replay while the first request is delivered or after it was
+	// delivered is rejected
+	replay := signedTestRequest(t, `2000`, body, signature)
+	if !signatureValid(replay, 42) {
+		t.Fatal(`replayed signature is not valid`)
+	}
+	if claimSignature(replay) {
+		t.Fatal(`replayed signature was claimed`)
+	}
+
+	// a retry after the first request failed is accepted
+	releaseSignature(first)
+	retry := signedTestRequest(t, `2000`, body, signature)
+	if !claimSignature(retry) {
+		t.Fatal(`retry after a failed request was rejected`)
+	}
+	// the failed request releases the signature only once
+	releaseSignature(first)
+	if claimSignature(signedTestRequest(t, `2000`, body, signature)) {
+		t.Fatal(`replay of the retry was claimed`)
+	}
+}
+
+func TestSignaturePrincipal(t *testing.T) {
+	testHostKeys(t)
+	const body = `{"hostID":42}`
+
+	r := signedTestRequest(t, `3000`, body, sign(`secret42`, `3000`, body))
+	if got := principalFor(r, 42); got != `host:42` {
+		t.Errorf("signed request has principal %q, expected host:42", got)
+	}
+
+	r = SetPrincipal(httptest.NewRequest(`POST`, `/`, nil), `user:alice`)
+	if got := principalFor(r, 42); got != `user:alice` {
+		t.Errorf("request has principal %q, expected user:alice", got)
+	}
+
+	// authorization rules apply to the HostID principal
+	Authorizer = testRules(t, `host:42 42`)
+	defer func() { Authorizer = nil }()
+	r = signedTestRequest(t, `3000`, body, sign(`secret42`, `3000`, body))
+	if !hostIDAllowed(r, 42) {
+		t.Error(`host:42 was denied HostID 42`)
+	}
+	r = signedTestRequest(t, `3000`, body, sign(`secret43`, `3000`, body))
+	if hostIDAllowed(r, 43) {
+		t.Error(`host:43 was allowed HostID 43`)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
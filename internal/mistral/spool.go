@@ -0,0 +1,538 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Spooler is the optional disk spool. If it is set, Endpoint writes
+// batches to it that could not be produced to Kafka
+var Spooler *Spool
+
+// ErrSpoolFull is returned by Spool.Write if the record would exceed
+// the configured spool size
+var ErrSpoolFull = fmt.Errorf(`Spool size limit reached`)
+
+// errSpoolChecksum is returned by readSpoolRecord for a record whose
+// data does not match its checksum
+var errSpoolChecksum = fmt.Errorf(`Spool: checksum mismatch`)
+
+// spoolHeaderLen is the length of the header before every record:
+// data length, crc32 of the data, unix timestamp in nanoseconds and
+// the HostID
+const spoolHeaderLen = 4 + 4 + 8 + 8
+
+// spoolSuffix is the filename suffix of spool segments
+const spoolSuffix = `.spool`
+
+// Spool is a segmented on-disk log of metric batches that could not
+// be produced to Kafka. As long as it holds records for a HostID that
+// were not yet replayed, it is engaged for that HostID and all new
+// batches for it are appended to it as well, so that batches for the
+// same HostID can not overtake each other. Batches for other HostIDs
+// are produced directly.
+//
+// Records are read ahead of the oldest record that is still being
+// replayed. Replayed records are removed from the spool once every
+// record before them is replayed as well.
+type Spool struct {
+	Shutdown chan struct{}
+	mux      sync.Mutex
+	path     string
+	segSize  int64
+	maxSize  int64
+	maxAge   time.Duration
+	segments []*spoolSegment
+	size     int64
+	depth    int64
+	hosts    map[int]int64
+	wfh      *os.File
+	rfh      *os.File
+	ridx     int
+	roff     int64
+	coff     int64
+	done     map[spoolPos]spoolDone
+}
+
+// spoolSegment is a single segment file of the spool
+type spoolSegment struct {
+	seq  int64
+	size int64
+}
+
+// spoolPos is the position of a record in the spool
+type spoolPos struct {
+	seq int64
+	off int64
+}
+
+// spoolDone describes a record that was removed from the spool while
+// records before it are still being replayed
+type spoolDone struct {
+	size  int64
+	count int64
+}
+
+// SpoolRecord is a single metric batch read from the spool
+type SpoolRecord struct {
+	HostID int
+	Value  []byte
+	Time   time.Time
+	pos    spoolPos
+}
+
+// NewSpool returns a Spool that stores its segments in path. Records
+// that are already present from an earlier run are picked up for
+// replay.
+func NewSpool(path string, segSize, maxSize int64,
+	maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		Shutdown: make(chan struct{}),
+		path:     path,
+		segSize:  segSize,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		segments: []*spoolSegment{},
+		hosts:    make(map[int]int64),
+		done:     make(map[spoolPos]spoolDone),
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(
+			strings.TrimSuffix(fi.Name(), spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{seq: seq})
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+
+	// count the records of every segment, truncating segments at
+	// the first torn record
+	for _, seg := range s.segments {
+		count, valid, err := s.scan(seg)
+		if err != nil {
+			return nil, err
+		}
+		seg.size = valid
+		s.size += valid
+		s.depth += count
+	}
+	s.updateMetrics()
+	return s, nil
+}
+
+// Engaged returns true if the spool holds records for hostID that
+// were not yet replayed. New batches queued behind them keep their
+// order, even if replaying a record fails and is retried.
+func (s *Spool) Engaged(hostID int) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.hosts[hostID] > 0
+}
+
+// Write appends the data for hostID to the spool
+func (s *Spool) Write(hostID int, data []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	rec := make([]byte, spoolHeaderLen+len(data))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(data))
+	binary.BigEndian.PutUint64(rec[8:16], uint64(time.Now().UTC().UnixNano()))
+	binary.BigEndian.PutUint64(rec[16:24], uint64(hostID))
+	copy(rec[spoolHeaderLen:], data)
+
+	if s.maxSize > 0 && s.size+int64(len(rec)) > s.maxSize {
+		return ErrSpoolFull
+	}
+
+	// start a new segment if there is no open segment or the current
+	// one is full
+	if s.wfh == nil || s.segments[len(s.segments)-1].size >= s.segSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	if _, err := s.wfh.Write(rec); err != nil {
+		// cut off the partial record
+		s.wfh.Truncate(seg.size)
+		return err
+	}
+	if err := s.wfh.Sync(); err != nil {
+		return err
+	}
+	seg.size += int64(len(rec))
+	s.size += int64(len(rec))
+	s.depth++
+	s.hosts[hostID]++
+	s.updateMetrics()
+	if MtrReg != nil {
+		metrics.GetOrRegisterMeter(`/spool/written`, *MtrReg).Mark(1)
+	}
+	return nil
+}
+
+// Next returns the oldest record that was not yet returned by Next,
+// without removing it from the spool. It returns nil if all records
+// were returned.
+func (s *Spool) Next() (*SpoolRecord, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for len(s.segments) > 0 {
+		// records removed during an earlier replay moved the start
+		// of the spool past the read position
+		if s.ridx == 0 && s.roff < s.coff {
+			s.roff = s.coff
+		}
+		seg := s.segments[s.ridx]
+		if s.roff >= seg.size {
+			if s.ridx == len(s.segments)-1 {
+				// all records were read
+				break
+			}
+			// continue with the next segment
+			s.closeReader()
+			s.ridx++
+			s.roff = 0
+			continue
+		}
+
+		pos := spoolPos{seq: seg.seq, off: s.roff}
+		if d, ok := s.done[pos]; ok {
+			// removed during an earlier replay
+			s.roff += d.size
+			continue
+		}
+
+		if s.rfh == nil {
+			fh, err := os.Open(s.segmentPath(seg))
+			if err != nil {
+				return nil, err
+			}
+			s.rfh = fh
+		}
+		rec, n, err := readSpoolRecord(s.rfh, s.roff, seg.size)
+		switch {
+		case err == errSpoolChecksum:
+			logrus.Errorf("Spool: skipped corrupt record in %s at offset %d",
+				s.rfh.Name(), s.roff)
+			s.roff += n
+			s.delivered(rec.HostID)
+			s.remove(pos, n, 1)
+			s.markCorrupt()
+			continue
+		case err == io.EOF:
+			// the record length is corrupt, the records behind it
+			// can not be found
+			logrus.Errorf("Spool: skipped %d unreadable bytes in %s at offset %d",
+				seg.size-s.roff, s.rfh.Name(), s.roff)
+			n = seg.size - s.roff
+			s.roff = seg.size
+			s.remove(pos, n, 0)
+			s.markCorrupt()
+			continue
+		case err != nil:
+			return nil, err
+		}
+		s.roff += n
+		rec.pos = pos
+
+		// records older than the maximum spool age are discarded
+		if s.maxAge > 0 && time.Since(rec.Time) > s.maxAge {
+			s.delivered(rec.HostID)
+			s.remove(pos, n, 1)
+			if MtrReg != nil {
+				metrics.GetOrRegisterMeter(`/spool/expired`,
+					*MtrReg).Mark(1)
+			}
+			continue
+		}
+		return rec, nil
+	}
+	return nil, nil
+}
+
+// Commit removes rec, which was returned by Next, from the spool
+func (s *Spool) Commit(rec *SpoolRecord) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.delivered(rec.HostID)
+	s.remove(rec.pos, int64(spoolHeaderLen+len(rec.Value)), 1)
+	if MtrReg != nil {
+		metrics.GetOrRegisterMeter(`/spool/replayed`, *MtrReg).Mark(1)
+	}
+}
+
+// Rewind makes Next start over with the oldest record that is still
+// in the spool. It is used after replaying a record failed.
+func (s *Spool) Rewind() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.closeReader()
+	s.ridx = 0
+	s.roff = s.coff
+}
+
+// Close closes the open segment files of the spool
+func (s *Spool) Close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.closeReader()
+	if s.wfh != nil {
+		s.wfh.Close()
+		s.wfh = nil
+	}
+}
+
+// remove marks size bytes holding count records at pos as removed.
+// Removed records at the start of the spool are deleted, the spool
+// is reset once it is empty. Must be called with the lock held.
+func (s *Spool) remove(pos spoolPos, size, count int64) {
+	s.done[pos] = spoolDone{size: size, count: count}
+
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if s.coff >= seg.size && len(s.segments) > 1 {
+			// the oldest segment is fully replayed
+			s.dropSegment()
+			continue
+		}
+		p := spoolPos{seq: seg.seq, off: s.coff}
+		d, ok := s.done[p]
+		if !ok {
+			break
+		}
+		delete(s.done, p)
+		s.coff += d.size
+		s.depth -= d.count
+	}
+
+	// the record count is too high if unreadable data was skipped
+	if s.depth <= 0 ||
+		(len(s.segments) == 1 && s.coff >= s.segments[0].size) {
+		s.reset()
+	}
+	s.updateMetrics()
+}
+
+// delivered records that a record for hostID left the spool. Must be
+// called with the lock held.
+func (s *Spool) delivered(hostID int) {
+	if s.hosts[hostID]--; s.hosts[hostID] <= 0 {
+		delete(s.hosts, hostID)
+	}
+}
+
+// closeReader closes the segment file Next reads from. Must be called
+// with the lock held.
+func (s *Spool) closeReader() {
+	if s.rfh != nil {
+		s.rfh.Close()
+		s.rfh = nil
+	}
+}
+
+// reset removes all segments of a fully replayed spool. Must be
+// called with the lock held.
+func (s *Spool) reset() {
+	s.closeReader()
+	if s.wfh != nil {
+		s.wfh.Close()
+		s.wfh = nil
+	}
+	for _, seg := range s.segments {
+		os.Remove(s.segmentPath(seg))
+	}
+	s.segments = s.segments[:0]
+	s.size = 0
+	s.depth = 0
+	s.hosts = make(map[int]int64)
+	s.ridx = 0
+	s.roff = 0
+	s.coff = 0
+	s.done = make(map[spoolPos]spoolDone)
+}
+
+// dropSegment removes the oldest, fully replayed segment. Must be
+// called with the lock held.
+func (s *Spool) dropSegment() {
+	seg := s.segments[0]
+	if s.ridx == 0 {
+		s.closeReader()
+		s.roff = 0
+	} else {
+		s.ridx--
+	}
+	s.segments = s.segments[1:]
+	s.coff = 0
+	s.size -= seg.size
+	os.Remove(s.segmentPath(seg))
+}
+
+// rotate opens a new segment for writing. Must be called with the
+// lock held.
+func (s *Spool) rotate() error {
+	seq := time.Now().UTC().UnixNano()
+	if l := len(s.segments); l > 0 && s.segments[l-1].seq >= seq {
+		seq = s.segments[l-1].seq + 1
+	}
+	seg := &spoolSegment{seq: seq}
+	fh, err := os.OpenFile(s.segmentPath(seg),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	if s.wfh != nil {
+		s.wfh.Close()
+	}
+	s.wfh = fh
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// scan counts the records in seg and truncates the segment after the
+// last complete record. Records with a checksum mismatch are counted,
+// they are skipped during the replay.
+func (s *Spool) scan(seg *spoolSegment) (int64, int64, error) {
+	fh, err := os.OpenFile(s.segmentPath(seg), os.O_RDWR, 0640)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var count, corrupt, off int64
+scanloop:
+	for off < fi.Size() {
+		rec, n, err := readSpoolRecord(fh, off, fi.Size())
+		switch {
+		case err == errSpoolChecksum:
+			corrupt++
+		case err == io.EOF:
+			break scanloop
+		case err != nil:
+			return 0, 0, err
+		}
+		count++
+		s.hosts[rec.HostID]++
+		off += n
+	}
+
+	if corrupt > 0 {
+		logrus.Warnf("Spool: %d corrupt records in %s will be skipped",
+			corrupt, fh.Name())
+	}
+	if off < fi.Size() {
+		logrus.Warnf("Spool: truncated %d bytes of a torn record in %s at offset %d",
+			fi.Size()-off, fh.Name(), off)
+		if MtrReg != nil {
+			metrics.GetOrRegisterMeter(`/spool/truncated`, *MtrReg).Mark(1)
+		}
+	}
+	return count, off, fh.Truncate(off)
+}
+
+// markCorrupt counts skipped corrupt data
+func (s *Spool) markCorrupt() {
+	if MtrReg != nil {
+		metrics.GetOrRegisterMeter(`/spool/corrupt`, *MtrReg).Mark(1)
+	}
+}
+
+// segmentPath returns the filename of seg
+func (s *Spool) segmentPath(seg *spoolSegment) string {
+	return filepath.Join(s.path,
+		fmt.Sprintf("%020d%s", seg.seq, spoolSuffix))
+}
+
+// updateMetrics exports the spool depth and size. Must be called
+// with the lock held.
+func (s *Spool) updateMetrics() {
+	if MtrReg == nil {
+		return
+	}
+	metrics.GetOrRegisterGauge(`/spool/depth`, *MtrReg).Update(s.depth)
+	metrics.GetOrRegisterGauge(`/spool/bytes`, *MtrReg).Update(s.size)
+}
+
+// readSpoolRecord reads the record at offset off from fh, whose data
+// ends at offset end. It returns the record and its length on disk.
+// The length and the HostID are also returned for a record with a
+// checksum mismatch.
+func readSpoolRecord(fh *os.File, off, end int64) (*SpoolRecord, int64, error) {
+	header := make([]byte, spoolHeaderLen)
+	if _, err := fh.ReadAt(header, off); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if off+spoolHeaderLen+int64(length) > end {
+		return nil, 0, io.EOF
+	}
+	data := make([]byte, length)
+	if _, err := fh.ReadAt(data, off+spoolHeaderLen); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return &SpoolRecord{
+			HostID: int(binary.BigEndian.Uint64(header[16:24])),
+		}, int64(spoolHeaderLen) + int64(length), errSpoolChecksum
+	}
+	return &SpoolRecord{
+		HostID: int(binary.BigEndian.Uint64(header[16:24])),
+		Value:  data,
+		Time: time.Unix(0,
+			int64(binary.BigEndian.Uint64(header[8:16]))).UTC(),
+	}, int64(spoolHeaderLen) + int64(length), nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,174 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+)
+
+// replayQueueLength is the number of records read ahead for every
+// application handler
+const replayQueueLength = 16
+
+// Replay drains the spool through the application handlers. Every
+// handler has one record in flight at a time and receives its
+// records in the order they were written, which keeps the ordering
+// for every HostID intact. If producing a record fails, the replay
+// starts over with it on the next tick. Batches for HostIDs without
+// spooled records bypass the spool meanwhile, so that the replay
+// only competes with new batches for the HostIDs it replays.
+func (s *Spool) Replay() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	defer s.Close()
+
+	for {
+		select {
+		case <-s.Shutdown:
+			return
+		case <-tick.C:
+		}
+
+		if !s.replayRound() {
+			return
+		}
+	}
+}
+
+// replayRound replays records until all records are replayed,
+// replaying a record failed or a shutdown is requested. It returns
+// false on shutdown.
+func (s *Spool) replayRound() bool {
+	defer s.Rewind()
+
+	// stop is closed once a record could not be replayed
+	stop := make(chan struct{})
+	once := sync.Once{}
+	halt := func() {
+		once.Do(func() { close(stop) })
+	}
+
+	// outstanding counts the records read but not yet replayed
+	var outstanding int64
+	queues := make([]chan *SpoolRecord, len(Handlers))
+	wg := sync.WaitGroup{}
+	for i := range queues {
+		queues[i] = make(chan *SpoolRecord, replayQueueLength)
+		wg.Add(1)
+		go func(queue chan *SpoolRecord) {
+			defer wg.Done()
+			for rec := range queue {
+				select {
+				case <-stop:
+					// records after the failed one are replayed
+					// in the next round
+				default:
+					if !s.replay(rec) {
+						halt()
+					}
+				}
+				atomic.AddInt64(&outstanding, -1)
+			}
+		}(queues[i])
+	}
+
+readloop:
+	for {
+		rec, err := s.Next()
+		if err != nil {
+			logrus.Errorf("Spool: could not read record: %s",
+				err.Error())
+			halt()
+			break readloop
+		}
+		if rec == nil {
+			// the round is over once all records are replayed,
+			// records written in the meantime are picked up
+			if atomic.LoadInt64(&outstanding) == 0 {
+				break readloop
+			}
+			select {
+			case <-stop:
+				break readloop
+			case <-s.Shutdown:
+				break readloop
+			case <-time.After(10 * time.Millisecond):
+			}
+			continue readloop
+		}
+
+		atomic.AddInt64(&outstanding, 1)
+		select {
+		case queues[shard(rec.HostID, len(queues))] <- rec:
+		case <-stop:
+			break readloop
+		case <-s.Shutdown:
+			break readloop
+		}
+	}
+	for i := range queues {
+		close(queues[i])
+	}
+	wg.Wait()
+
+	select {
+	case <-s.Shutdown:
+		return false
+	default:
+		return true
+	}
+}
+
+// replay produces rec through its application handler and waits for
+// the result. It returns false if rec has to be retried or a
+// shutdown is requested.
+func (s *Spool) replay(rec *SpoolRecord) bool {
+	// the result is buffered, since it is not read anymore after a
+	// shutdown
+	ret := make(chan error, 1)
+	if !dispatchUntil(erebos.Transport{
+		HostID: rec.HostID,
+		Value:  rec.Value,
+		Return: ret,
+	}, s.Shutdown) {
+		return false
+	}
+
+	var err error
+	select {
+	case <-s.Shutdown:
+		return false
+	case err = <-ret:
+	}
+	if err != nil && permanentError(err) {
+		// retrying does not help, keep the batch for investigation
+		// instead
+		logrus.Errorf("Spool: dropped record for HostID %d: %s",
+			rec.HostID, err.Error())
+		deadLetter(err.Error(), ``, rec.HostID, rec.Value)
+		s.Commit(rec)
+		return true
+	}
+	if err != nil {
+		logrus.Warnf("Spool: replay for HostID %d failed: %s",
+			rec.HostID, err.Error())
+		return false
+	}
+	s.Commit(rec)
+	logrus.Infof("Spool: replayed metric data for HostID %d",
+		rec.HostID)
+	return true
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,280 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSpool opens a spool in a temporary directory
+func testSpool(t *testing.T, segSize int64, maxAge time.Duration) (*Spool, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir(``, `mistral-spool`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := NewSpool(dir, segSize, 0, maxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+// writeRecords writes count records with the values 0 to count-1
+func writeRecords(t *testing.T, s *Spool, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if err := s.Write(i%3+1, []byte(fmt.Sprintf("batch-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// drain replays and commits all records of s and returns their values
+func drain(t *testing.T, s *Spool) []string {
+	t.Helper()
+	values := []string{}
+	for {
+		rec, err := s.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec == nil {
+			return values
+		}
+		values = append(values, string(rec.Value))
+		s.Commit(rec)
+	}
+}
+
+// segmentFiles returns the spool segments in dir
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, `*`+spoolSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// expectValues compares the replayed values with the indices in want
+func expectValues(t *testing.T, got []string, want ...int) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d records, expected %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != fmt.Sprintf("batch-%d", want[i]) {
+			t.Fatalf("record %d is %s, expected batch-%d", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSpoolReopenReplaysInOrder(t *testing.T) {
+	s, dir := testSpool(t, 1024*1024, 0)
+	writeRecords(t, s, 5)
+	s.Close()
+
+	s, err := NewSpool(dir, 1024*1024, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Engaged(1) {
+		t.Fatal(`reopened spool with records is not engaged`)
+	}
+	expectValues(t, drain(t, s), 0, 1, 2, 3, 4)
+	if s.Engaged(1) {
+		t.Fatal(`empty spool is engaged`)
+	}
+	if files := segmentFiles(t, dir); len(files) != 0 {
+		t.Fatalf("empty spool left segments behind: %v", files)
+	}
+}
+
+func TestSpoolSegmentRotation(t *testing.T) {
+	// every segment holds two records
+	s, dir := testSpool(t, int64(2*(spoolHeaderLen+len(`batch-0`))), 0)
+	writeRecords(t, s, 6)
+	if files := segmentFiles(t, dir); len(files) != 3 {
+		t.Fatalf("wrote %d segments, expected 3", len(files))
+	}
+
+	for i := 0; i < 3; i++ {
+		rec, err := s.Next()
+		if err != nil || rec == nil {
+			t.Fatalf("Next: %v, %v", rec, err)
+		}
+		s.Commit(rec)
+	}
+	// the first segment is replayed completely
+	if files := segmentFiles(t, dir); len(files) != 2 {
+		t.Fatalf("%d segments left, expected 2", len(files))
+	}
+	expectValues(t, drain(t, s), 3, 4, 5)
+}
+
+func TestSpoolTruncatesTornRecord(t *testing.T) {
+	s, dir := testSpool(t, 1024*1024, 0)
+	writeRecords(t, s, 3)
+	s.Close()
+
+	files := segmentFiles(t, dir)
+	fi, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// append the first half of a record header
+	fh, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Write(make([]byte, spoolHeaderLen/2))
+	fh.Close()
+
+	s, err = NewSpool(dir, 1024*1024, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated.Size() != fi.Size() {
+		t.Fatalf("segment has %d bytes, expected %d", truncated.Size(), fi.Size())
+	}
+	expectValues(t, drain(t, s), 0, 1, 2)
+}
+
+func TestSpoolSkipsCorruptRecord(t *testing.T) {
+	s, dir := testSpool(t, 1024*1024, 0)
+	writeRecords(t, s, 3)
+	s.Close()
+
+	// flip a data byte of the second record
+	files := segmentFiles(t, dir)
+	fh, err := os.OpenFile(files[0], os.O_RDWR, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteAt([]byte{'X'}, 2*spoolHeaderLen+int64(len(`batch-0`)))
+	fh.Close()
+
+	s, err = NewSpool(dir, 1024*1024, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, drain(t, s), 0, 2)
+	if s.Engaged(2) {
+		t.Fatal(`spool is engaged after skipping a corrupt record`)
+	}
+}
+
+func TestSpoolSkipsUnreadableLength(t *testing.T) {
+	// every segment holds two records
+	s, dir := testSpool(t, int64(2*(spoolHeaderLen+len(`batch-0`))), 0)
+	writeRecords(t, s, 4)
+
+	// point the length of the second record past the segment end
+	// while the spool is open
+	files := segmentFiles(t, dir)
+	fh, err := os.OpenFile(files[0], os.O_RDWR, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteAt([]byte{0xff}, spoolHeaderLen+int64(len(`batch-0`)))
+	fh.Close()
+
+	expectValues(t, drain(t, s), 0, 2, 3)
+	if s.Engaged(1) || s.Engaged(3) {
+		t.Fatal(`spool is engaged after skipping unreadable data`)
+	}
+}
+
+func TestSpoolExpiry(t *testing.T) {
+	s, dir := testSpool(t, 1024*1024, 10*time.Millisecond)
+	writeRecords(t, s, 2)
+	time.Sleep(20 * time.Millisecond)
+	if err := s.Write(1, []byte(`batch-2`)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValues(t, drain(t, s), 2)
+	if files := segmentFiles(t, dir); len(files) != 0 {
+		t.Fatalf("empty spool left segments behind: %v", files)
+	}
+}
+
+func TestSpoolRewind(t *testing.T) {
+	s, _ := testSpool(t, 1024*1024, 0)
+	writeRecords(t, s, 3)
+
+	first, _ := s.Next()
+	second, _ := s.Next()
+
+	// the second record is replayed, the first one failed
+	s.Commit(second)
+	s.Rewind()
+	if !s.Engaged(first.HostID) {
+		t.Fatal(`spool with a failed record is not engaged for its HostID`)
+	}
+	expectValues(t, drain(t, s), 0, 2)
+}
+
+func TestSpoolEngagedPerHostID(t *testing.T) {
+	s, _ := testSpool(t, 1024*1024, 0)
+	// HostIDs 1, 2, 3, 1
+	writeRecords(t, s, 4)
+
+	for hostID, engaged := range map[int]bool{1: true, 2: true, 3: true, 4: false} {
+		if s.Engaged(hostID) != engaged {
+			t.Errorf("HostID %d engaged %t, expected %t", hostID, !engaged, engaged)
+		}
+	}
+
+	// HostID 1 stays engaged until both of its records are replayed,
+	// even after the first one was read
+	rec, _ := s.Next()
+	if !s.Engaged(1) {
+		t.Fatal(`HostID 1 is not engaged with an unreplayed record`)
+	}
+	s.Commit(rec)
+	if !s.Engaged(1) {
+		t.Fatal(`HostID 1 is not engaged with one record left`)
+	}
+
+	expectValues(t, drain(t, s), 1, 2, 3)
+	for hostID := 1; hostID <= 3; hostID++ {
+		if s.Engaged(hostID) {
+			t.Errorf("HostID %d is engaged after the replay", hostID)
+		}
+	}
+}
+
+func TestSpoolReopenEngagesHostIDs(t *testing.T) {
+	s, dir := testSpool(t, 1024*1024, 0)
+	writeRecords(t, s, 2)
+	s.Close()
+
+	s, err := NewSpool(dir, 1024*1024, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Engaged(1) || !s.Engaged(2) || s.Engaged(3) {
+		t.Fatal(`reopened spool is not engaged for the spooled HostIDs only`)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
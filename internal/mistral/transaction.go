@@ -0,0 +1,158 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// ErrTxnAborted is returned for batches that were written to Kafka
+// within a transaction that was aborted afterwards
+var ErrTxnAborted = errors.New(`mistral: Kafka transaction aborted`)
+
+// transaction is the Kafka transaction state of a transactional
+// handler. A transaction is open from the first batch produced
+// within it until the results of all its batches are in. Batches
+// that arrive after the producer returned the first result are held
+// back for the next transaction.
+type transaction struct {
+	open    bool
+	closing bool
+	err     error
+	fatal   error
+	results []txnResult
+	backlog []*erebos.Transport
+}
+
+// txnResult is the producer result of a batch within a transaction
+type txnResult struct {
+	msg *sarama.ProducerMessage
+	err error
+}
+
+// admit returns true if msg can be produced within the current
+// transaction, which is started if required
+func (m *Mistral) admit(msg *erebos.Transport) bool {
+	if m.txn.closing {
+		m.txn.backlog = append(m.txn.backlog, msg)
+		return false
+	}
+	if m.txn.open {
+		return true
+	}
+
+	if err := m.producer.BeginTxn(); err != nil {
+		logrus.Errorf("Mistral[%d]: could not begin transaction: %s",
+			m.Num, err.Error())
+		m.checkFatal(err)
+		m.updateQueueWait(requestFor(msg.Return))
+		m.reply(msg, err)
+		return false
+	}
+	m.txn.open = true
+	return true
+}
+
+// holdForCommit records the producer result of msg. Once the results
+// of all batches within the transaction are in, the transaction is
+// finished.
+func (m *Mistral) holdForCommit(msg *sarama.ProducerMessage, err error) {
+	m.txn.closing = true
+	m.txn.results = append(m.txn.results, txnResult{msg: msg, err: err})
+	if err != nil && m.txn.err == nil {
+		m.txn.err = err
+	}
+
+	// every tracked batch is part of the transaction
+	if len(m.txn.results) < len(m.trackID) {
+		return
+	}
+	m.finishTxn()
+}
+
+// finishTxn commits the transaction, or aborts it if a batch failed,
+// and acks all client requests within it. The held back batches are
+// produced afterwards.
+func (m *Mistral) finishTxn() {
+	err := m.txn.err
+	if err == nil {
+		if err = m.producer.CommitTxn(); err != nil {
+			logrus.Errorf("Mistral[%d]: could not commit transaction: %s",
+				m.Num, err.Error())
+		}
+	}
+
+	if err == nil {
+		metrics.GetOrRegisterMeter(`/transaction/commit`,
+			*m.Metrics).Mark(1)
+	} else {
+		if abortErr := m.producer.AbortTxn(); abortErr != nil {
+			logrus.Errorf("Mistral[%d]: could not abort transaction: %s",
+				m.Num, abortErr.Error())
+		}
+		m.checkFatal(err)
+		metrics.GetOrRegisterMeter(`/transaction/abort`,
+			*m.Metrics).Mark(1)
+	}
+
+	// batches that were written are rolled back with the aborted
+	// transaction
+	for _, res := range m.txn.results {
+		switch {
+		case res.err != nil:
+			m.ack(res.msg, res.err)
+		case err != nil:
+			m.ack(res.msg, ErrTxnAborted)
+		default:
+			m.ack(res.msg, nil)
+		}
+	}
+
+	backlog := m.txn.backlog
+	m.txn = transaction{fatal: m.txn.fatal}
+	for _, msg := range backlog {
+		m.process(msg)
+	}
+}
+
+// checkFatal records if the producer can not continue after err, for
+// example because it was fenced by another instance using the same
+// transactional ID
+func (m *Mistral) checkFatal(err error) {
+	if m.txn.fatal != nil ||
+		m.producer.TxnStatus()&sarama.ProducerTxnFlagFatalError == 0 {
+		return
+	}
+	m.txn.fatal = fmt.Errorf(
+		"Mistral[%d]: transactional producer failed: %s",
+		m.Num, err.Error(),
+	)
+}
+
+// txnFailed returns the error that stopped the transactional producer
+func (m *Mistral) txnFailed() error {
+	return m.txn.fatal
+}
+
+// txnSettled returns true if no transaction waits for outstanding
+// producer results or holds back batches
+func (m *Mistral) txnSettled() bool {
+	if !m.producer.IsTransactional() {
+		return true
+	}
+	return len(m.trackID) == 0 && len(m.txn.backlog) == 0
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
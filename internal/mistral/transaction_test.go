@@ -0,0 +1,241 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mistral // import "github.com/solnx/mistral/internal/mistral"
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mjolnir42/delay"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// txnProducer is a transactional producer that records the
+// transaction calls and fails them as configured
+type txnProducer struct {
+	sarama.AsyncProducer
+	status    sarama.ProducerTxnStatusFlag
+	commitErr error
+	begun     int
+	committed int
+	aborted   int
+}
+
+func (p *txnProducer) IsTransactional() bool { return true }
+
+func (p *txnProducer) TxnStatus() sarama.ProducerTxnStatusFlag { return p.status }
+
+func (p *txnProducer) BeginTxn() error {
+	p.begun++
+	return nil
+}
+
+func (p *txnProducer) CommitTxn() error {
+	if p.commitErr != nil {
+		return p.commitErr
+	}
+	p.committed++
+	return nil
+}
+
+func (p *txnProducer) AbortTxn() error {
+	p.aborted++
+	return nil
+}
+
+// testTxnHandler returns a transactional handler producing via p
+func testTxnHandler(p *txnProducer) (*Mistral, chan *sarama.ProducerMessage) {
+	reg := metrics.NewRegistry()
+	dispatch := make(chan *sarama.ProducerMessage, 8)
+	return &Mistral{
+		Num:       0,
+		Config:    &Config{},
+		Metrics:   &reg,
+		delay:     delay.New(),
+		trackID:   make(map[string]*erebos.Transport),
+		trackTime: make(map[string]time.Time),
+		dispatch:  dispatch,
+		producer:  p,
+	}, dispatch
+}
+
+// produceBatch hands a batch to the handler and returns its result
+// channel
+func produceBatch(m *Mistral, hostID int) chan error {
+	ret := make(chan error, 1)
+	m.process(&erebos.Transport{
+		HostID: hostID,
+		Value:  []byte(`{}`),
+		Return: ret,
+	})
+	return ret
+}
+
+// batchOf returns the index of the batch within rets that msg was
+// produced for, since batches are dispatched concurrently
+func batchOf(m *Mistral, msg *sarama.ProducerMessage, rets []chan error) int {
+	ret := m.trackID[msg.Metadata.(string)].Return
+	for i := range rets {
+		if rets[i] == ret {
+			return i
+		}
+	}
+	return -1
+}
+
+// result returns the result sent to the client on ret
+func result(t *testing.T, ret chan error) error {
+	t.Helper()
+	select {
+	case err := <-ret:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal(`no result was sent to the client`)
+	}
+	return nil
+}
+
+func TestFinishTxnCommit(t *testing.T) {
+	p := &txnProducer{}
+	m, dispatch := testTxnHandler(p)
+
+	first, second := produceBatch(m, 1), produceBatch(m, 2)
+	m.ackClientRequest(<-dispatch, nil)
+	if p.committed != 0 {
+		t.Fatal(`transaction committed before all results were in`)
+	}
+	m.ackClientRequest(<-dispatch, nil)
+
+	if p.begun != 1 || p.committed != 1 || p.aborted != 0 {
+		t.Errorf("begun %d, committed %d, aborted %d transactions",
+			p.begun, p.committed, p.aborted)
+	}
+	for _, ret := range []chan error{first, second} {
+		if err := result(t, ret); err != nil {
+			t.Errorf("committed batch failed: %s", err)
+		}
+	}
+	if len(m.trackID) != 0 || m.txn.open {
+		t.Error(`transaction state was not reset`)
+	}
+}
+
+func TestFinishTxnAbort(t *testing.T) {
+	produceErr := errors.New(`message too large`)
+	tests := []struct {
+		name      string
+		commitErr error
+		errs      []error
+		want      []error
+	}{
+		{
+			name: `failed batch`,
+			errs: []error{nil, produceErr},
+			want: []error{ErrTxnAborted, produceErr},
+		},
+		{
+			name:      `failed commit`,
+			commitErr: errors.New(`coordinator not available`),
+			errs:      []error{nil, nil},
+			want:      []error{ErrTxnAborted, ErrTxnAborted},
+		},
+	}
+	for _, tt := range tests {
+		p := &txnProducer{commitErr: tt.commitErr}
+		m, dispatch := testTxnHandler(p)
+
+		rets := []chan error{produceBatch(m, 1), produceBatch(m, 2)}
+		for range tt.errs {
+			msg := <-dispatch
+			m.ackClientRequest(msg, tt.errs[batchOf(m, msg, rets)])
+		}
+
+		if p.committed != 0 || p.aborted != 1 {
+			t.Errorf("%s: committed %d, aborted %d transactions", tt.name,
+				p.committed, p.aborted)
+		}
+		for i, ret := range rets {
+			if err := result(t, ret); err != tt.want[i] {
+				t.Errorf("%s: batch %d failed with %v, expected %v",
+					tt.name, i, err, tt.want[i])
+			}
+		}
+		if m.txnFailed() != nil {
+			t.Errorf("%s: producer failed without fatal status", tt.name)
+		}
+	}
+}
+
+func TestFinishTxnBacklog(t *testing.T) {
+	p := &txnProducer{}
+	m, dispatch := testTxnHandler(p)
+
+	first := produceBatch(m, 1)
+	second := produceBatch(m, 2)
+	m.ackClientRequest(<-dispatch, nil)
+
+	// the transaction is closing, later batches are held back
+	held := produceBatch(m, 3)
+	if len(m.txn.backlog) != 1 {
+		t.Fatalf("%d batches held back, expected 1", len(m.txn.backlog))
+	}
+
+	m.ackClientRequest(<-dispatch, nil)
+	for _, ret := range []chan error{first, second} {
+		if err := result(t, ret); err != nil {
+			t.Errorf("committed batch failed: %s", err)
+		}
+	}
+
+	// the held back batch starts the next transaction
+	if p.begun != 2 || len(m.txn.backlog) != 0 || !m.txn.open {
+		t.Fatalf("held back batch was not produced, %d transactions begun",
+			p.begun)
+	}
+	m.ackClientRequest(<-dispatch, nil)
+	if err := result(t, held); err != nil || p.committed != 2 {
+		t.Errorf("held back batch: %v, %d transactions committed", err,
+			p.committed)
+	}
+}
+
+func TestCheckFatal(t *testing.T) {
+	p := &txnProducer{}
+	m, dispatch := testTxnHandler(p)
+
+	m.checkFatal(errors.New(`abortable error`))
+	if m.txnFailed() != nil {
+		t.Fatal(`abortable error stopped the producer`)
+	}
+
+	p.status = sarama.ProducerTxnFlagInError | sarama.ProducerTxnFlagFatalError
+	m.checkFatal(errors.New(`producer fenced`))
+	m.checkFatal(errors.New(`later error`))
+	err := m.txnFailed()
+	if err == nil {
+		t.Fatal(`fatal error did not stop the producer`)
+	}
+	want := `Mistral[0]: transactional producer failed: producer fenced`
+	if err.Error() != want {
+		t.Errorf("error %q, expected %q", err, want)
+	}
+
+	// the fatal error survives the reset of the transaction state
+	ret := produceBatch(m, 1)
+	m.ackClientRequest(<-dispatch, nil)
+	result(t, ret)
+	if m.txnFailed() == nil || m.txn.open {
+		t.Error(`fatal error was dropped with the transaction`)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix